@@ -5,6 +5,8 @@ type AudiobookTrack struct {
 	Ord      int    `json:"ord"`
 	Title    string `json:"title"`
 	Filename string `json:"filename"`
+	// Duration is the duration of the track in seconds.
+	Duration int    `json:"duration,omitempty"`
 }
 
 // Audiobook describes an audiobook.
@@ -14,10 +16,25 @@ type Audiobook struct {
 	Title  			string 			`json:"title"`
 	ArchiveFile string 			`json:"archiveFile"`
 	Tracks []AudiobookTrack `json:"tracks"`
+	// CoverImage is the cover image file, relative to the base URL.
+	CoverImage  string      `json:"coverImage,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Series      string      `json:"series,omitempty"`
+	// SeriesIndex is the position of the audiobook in its series.
+	SeriesIndex int         `json:"seriesIndex,omitempty"`
+	// AgeRating is the minimum recommended age.
+	AgeRating   int         `json:"ageRating,omitempty"`
+	// Language is the ISO 639-1 language code.
+	Language    string      `json:"language,omitempty"`
+	// Duration is the total duration in seconds.
+	Duration    int         `json:"duration,omitempty"`
 }
 
 // AudiobookDirectory describes an audiobook directory.
 type AudiobookDirectory struct {
+	// SchemaVersion is the version of the schema the directory was written
+	// with. Directories without version are version 0.
+	SchemaVersion int     `json:"schemaVersion"`
 	ID      string      `json:"id"`
 	BaseURL string      `json:"baseURL"`
 	Books   []Audiobook `json:"books"`
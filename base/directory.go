@@ -0,0 +1,78 @@
+package base
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// DirectorySchemaVersion is the schema version of directories written by
+// this version.
+const DirectorySchemaVersion = 1
+
+// migrations upgrade a directory from the schema version they are keyed
+// with to the next version.
+var migrations = map[int]func(*AudiobookDirectory){
+	0: migrateFromVersion0,
+}
+
+// ParseDirectory decodes a directory file. Syntax errors, type errors and
+// entries without ID are reported as errors. Fields unknown to this version
+// are ignored, so directories written with a newer schema version can
+// still be read.
+func ParseDirectory(data []byte) (*AudiobookDirectory, error) {
+	directory := new(AudiobookDirectory)
+	if err := json.Unmarshal(data, directory); err != nil {
+		return nil, fmt.Errorf("invalid directory file: %v", err)
+	}
+	if directory.SchemaVersion > DirectorySchemaVersion {
+		log.Printf("[base] directory has schema version %d, newer than supported version %d, ignoring unknown fields", directory.SchemaVersion, DirectorySchemaVersion)
+	}
+	for idx, book := range directory.Books {
+		if book.ID == "" {
+			return nil, fmt.Errorf("invalid directory file: entry %d (%s %s) has no id", idx, book.Artist, book.Title)
+		}
+	}
+	return directory, nil
+}
+
+// MigrateDirectory upgrades the directory to the current schema version.
+// Directories with a newer schema version can not be migrated, because
+// writing them back would drop the fields unknown to this version.
+func MigrateDirectory(directory *AudiobookDirectory) error {
+	if directory.SchemaVersion > DirectorySchemaVersion {
+		return fmt.Errorf("directory schema version %d is newer than supported version %d, please update", directory.SchemaVersion, DirectorySchemaVersion)
+	}
+	for directory.SchemaVersion < DirectorySchemaVersion {
+		log.Printf("[base] migrating directory from schema version %d", directory.SchemaVersion)
+		migrations[directory.SchemaVersion](directory)
+		directory.SchemaVersion++
+	}
+	return nil
+}
+
+// migrateFromVersion0 upgrades directories written before schema versions
+// were introduced. These used the track filename as title and had no
+// durations.
+func migrateFromVersion0(directory *AudiobookDirectory) {
+	for bookIdx := range directory.Books {
+		book := &directory.Books[bookIdx]
+		duration := 0
+		for trackIdx := range book.Tracks {
+			track := &book.Tracks[trackIdx]
+			if track.Ord == 0 {
+				track.Ord = trackIdx + 1
+			}
+			if track.Title == "" || track.Title == track.Filename {
+				// the files were tagged with the filename without extension.
+				track.Title = strings.TrimSuffix(track.Filename, filepath.Ext(track.Filename))
+			}
+			duration += track.Duration
+		}
+		if book.Duration == 0 {
+			book.Duration = duration
+		}
+	}
+}
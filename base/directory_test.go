@@ -0,0 +1,74 @@
+package base
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDirectory(t *testing.T) {
+	t.Run("parsing directory", func(t *testing.T) {
+		directory, err := ParseDirectory([]byte(`{"schemaVersion":1,"id":"dir","baseURL":"http://example.com/","books":[
+			{"id":"111","artist":"aa","title":"ta","archiveFile":"aa - ta.zip","tracks":[{"ord":1,"title":"Chapter 1","filename":"01.mp3","duration":42}]}
+		]}`))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, directory.SchemaVersion)
+		assert.Len(t, directory.Books, 1)
+		assert.Equal(t, 42, directory.Books[0].Tracks[0].Duration)
+	})
+	t.Run("ignoring unknown fields", func(t *testing.T) {
+		directory, err := ParseDirectory([]byte(`{"schemaVersion":99,"id":"dir","futureField":true,"books":[
+			{"id":"111","artist":"aa","title":"ta","archiveFile":"aa - ta.zip","rating":5}
+		]}`))
+		assert.NoError(t, err)
+		assert.Equal(t, 99, directory.SchemaVersion)
+		assert.Equal(t, "111", directory.Books[0].ID)
+	})
+	t.Run("rejecting invalid json", func(t *testing.T) {
+		_, err := ParseDirectory([]byte(`{"id":"dir","books":[`))
+		assert.Error(t, err)
+	})
+	t.Run("rejecting invalid types", func(t *testing.T) {
+		_, err := ParseDirectory([]byte(`{"id":"dir","books":{"id":"111"}}`))
+		assert.Error(t, err)
+	})
+	t.Run("rejecting incomplete entries", func(t *testing.T) {
+		_, err := ParseDirectory([]byte(`{"id":"dir","books":[{"artist":"aa","title":"ta"}]}`))
+		assert.Error(t, err)
+	})
+}
+
+func TestMigrateDirectory(t *testing.T) {
+	t.Run("migrating version 0", func(t *testing.T) {
+		directory := &AudiobookDirectory{
+			Books: []Audiobook{
+				Audiobook{ID: "111", Tracks: []AudiobookTrack{
+					AudiobookTrack{Ord: 1, Title: "01.mp3", Filename: "01.mp3", Duration: 10},
+					AudiobookTrack{Title: "", Filename: "02.mp3", Duration: 20},
+				}},
+			},
+		}
+		assert.NoError(t, MigrateDirectory(directory))
+		assert.Equal(t, DirectorySchemaVersion, directory.SchemaVersion)
+		assert.Equal(t, "01", directory.Books[0].Tracks[0].Title)
+		assert.Equal(t, 2, directory.Books[0].Tracks[1].Ord)
+		assert.Equal(t, "02", directory.Books[0].Tracks[1].Title)
+		assert.Equal(t, 30, directory.Books[0].Duration)
+	})
+	t.Run("keeping current version", func(t *testing.T) {
+		directory := &AudiobookDirectory{
+			SchemaVersion: DirectorySchemaVersion,
+			Books: []Audiobook{
+				Audiobook{ID: "111", Tracks: []AudiobookTrack{
+					AudiobookTrack{Ord: 1, Title: "01.mp3", Filename: "01.mp3"},
+				}},
+			},
+		}
+		assert.NoError(t, MigrateDirectory(directory))
+		assert.Equal(t, "01.mp3", directory.Books[0].Tracks[0].Title)
+	})
+	t.Run("rejecting newer version", func(t *testing.T) {
+		directory := &AudiobookDirectory{SchemaVersion: DirectorySchemaVersion + 1}
+		assert.Error(t, MigrateDirectory(directory))
+	})
+}
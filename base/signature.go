@@ -0,0 +1,81 @@
+package base
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// SignatureSuffix is appended to the directory file name to get the name of
+// its detached signature.
+const SignatureSuffix = ".sig"
+
+// GenerateSigningKey creates a new Ed25519 key pair for signing directory
+// files. Both keys are returned base64 encoded, the private key as seed.
+func GenerateSigningKey() (string, string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(privateKey.Seed()), base64.StdEncoding.EncodeToString(publicKey), nil
+}
+
+// LoadSigningKey reads a base64 encoded Ed25519 private key from a file.
+// The file may contain either the seed or the full private key.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	keyBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := decodeKey(string(keyBytes))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key in %s: %v", path, err)
+	}
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	}
+	return nil, fmt.Errorf("invalid signing key in %s: unexpected length %d", path, len(key))
+}
+
+// ParsePublicKey decodes a base64 encoded Ed25519 public key.
+func ParsePublicKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := decodeKey(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key: unexpected length %d", len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// SignDirectory returns the base64 encoded detached signature of the
+// directory file content.
+func SignDirectory(data []byte, key ed25519.PrivateKey) []byte {
+	signature := ed25519.Sign(key, data)
+	return []byte(base64.StdEncoding.EncodeToString(signature) + "\n")
+}
+
+// VerifyDirectory checks the detached signature of the directory file
+// content against the public key.
+func VerifyDirectory(data []byte, signature []byte, key ed25519.PublicKey) error {
+	signatureBytes, err := decodeKey(string(signature))
+	if err != nil {
+		return fmt.Errorf("invalid directory signature: %v", err)
+	}
+	if len(signatureBytes) != ed25519.SignatureSize || !ed25519.Verify(key, data, signatureBytes) {
+		return errors.New("directory signature does not match")
+	}
+	return nil
+}
+
+func decodeKey(encoded string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+}
@@ -0,0 +1,48 @@
+package base
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignature(t *testing.T) {
+	privateKey, publicKey, err := GenerateSigningKey()
+	assert.NoError(t, err)
+	path, err := ioutil.TempDir("", "piena-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(path)
+	keyFile := filepath.Join(path, "signing.key")
+	assert.NoError(t, ioutil.WriteFile(keyFile, []byte(privateKey+"\n"), 0600))
+	signingKey, err := LoadSigningKey(keyFile)
+	assert.NoError(t, err)
+	verifyKey, err := ParsePublicKey(publicKey)
+	assert.NoError(t, err)
+	data := []byte(`{"schemaVersion":1,"id":"dir","books":[]}`)
+	signature := SignDirectory(data, signingKey)
+	t.Run("verifying signature", func(t *testing.T) {
+		assert.NoError(t, VerifyDirectory(data, signature, verifyKey))
+	})
+	t.Run("rejecting tampered directory", func(t *testing.T) {
+		tampered := []byte(`{"schemaVersion":1,"id":"evil","books":[]}`)
+		assert.Error(t, VerifyDirectory(tampered, signature, verifyKey))
+	})
+	t.Run("rejecting other key", func(t *testing.T) {
+		_, otherPublicKey, err := GenerateSigningKey()
+		assert.NoError(t, err)
+		otherKey, err := ParsePublicKey(otherPublicKey)
+		assert.NoError(t, err)
+		assert.Error(t, VerifyDirectory(data, signature, otherKey))
+	})
+	t.Run("rejecting invalid signature", func(t *testing.T) {
+		assert.Error(t, VerifyDirectory(data, []byte("not a signature"), verifyKey))
+		assert.Error(t, VerifyDirectory(data, nil, verifyKey))
+	})
+	t.Run("rejecting invalid public key", func(t *testing.T) {
+		_, err := ParsePublicKey("c2hvcnQ=")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,56 @@
+package base
+
+import (
+	"strings"
+)
+
+// paddedUIDLength is the length of UIDs formatted over the full 10 bytes
+// UID buffer of libnfc, as done by previous versions.
+const paddedUIDLength = 20
+
+// NormalizeTagID returns the canonical form of a tag ID: uppercase hex
+// without 0x prefix and colon separators. IDs of other tag types keep their
+// type prefix.
+func NormalizeTagID(id string) string {
+	id = strings.TrimSpace(id)
+	if strings.HasPrefix(id, "0x") || strings.HasPrefix(id, "0X") {
+		id = id[2:]
+	}
+	id = strings.Replace(id, ":", "", -1)
+	return strings.ToUpper(id)
+}
+
+// FormatTagID returns the canonical form of a tag ID, with colons between
+// the bytes if requested.
+func FormatTagID(id string, colons bool) string {
+	id = NormalizeTagID(id)
+	if !colons {
+		return id
+	}
+	prefix, hex := "", id
+	if idx := strings.LastIndex(id, "-"); idx >= 0 {
+		prefix, hex = id[:idx+1], id[idx+1:]
+	}
+	if len(hex)%2 != 0 {
+		return id
+	}
+	bytes := []string{}
+	for idx := 0; idx < len(hex); idx += 2 {
+		bytes = append(bytes, hex[idx:idx+2])
+	}
+	return prefix + strings.Join(bytes, ":")
+}
+
+// TagIDsMatch compares two tag IDs in their canonical form. UIDs padded
+// with zeros to 10 bytes, as written by previous versions, match their
+// truncated form.
+func TagIDsMatch(a string, b string) bool {
+	a, b = NormalizeTagID(a), NormalizeTagID(b)
+	if a == b {
+		return true
+	}
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	return b != "" && len(a) == paddedUIDLength && strings.HasPrefix(a, b) && strings.Trim(a[len(b):], "0") == ""
+}
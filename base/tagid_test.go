@@ -0,0 +1,32 @@
+package base
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTagIDs(t *testing.T) {
+	t.Run("normalizing ids", func(t *testing.T) {
+		assert.Equal(t, "04A1B2C3", NormalizeTagID("0x04a1b2c3"))
+		assert.Equal(t, "04A1B2C3", NormalizeTagID(" 04:a1:b2:c3 "))
+		assert.Equal(t, "FELICA-012E4C0000000001", NormalizeTagID("FELICA-012e4c0000000001"))
+		assert.Equal(t, "4711", NormalizeTagID("4711"))
+	})
+	t.Run("formatting ids", func(t *testing.T) {
+		assert.Equal(t, "04A1B2C3", FormatTagID("0x04a1b2c3", false))
+		assert.Equal(t, "04:A1:B2:C3", FormatTagID("0x04a1b2c3", true))
+		assert.Equal(t, "FELICA-01:2E:4C:00:00:00:00:01", FormatTagID("FELICA-012E4C0000000001", true))
+		assert.Equal(t, "ABC", FormatTagID("abc", true))
+	})
+	t.Run("matching ids", func(t *testing.T) {
+		assert.True(t, TagIDsMatch("0x04a1b2c3", "04:A1:B2:C3"))
+		// padded uids of previous versions.
+		assert.True(t, TagIDsMatch("0x04a1b2c3000000000000", "04A1B2C3"))
+		assert.True(t, TagIDsMatch("04A1B2C3", "0x04a1b2c3000000000000"))
+		assert.False(t, TagIDsMatch("0x04a1b2c3000000000000", "04A1"))
+		assert.False(t, TagIDsMatch("04A1B2C3", "04A1B2C4"))
+		assert.False(t, TagIDsMatch("04A1B2C300", "04A1B2C3"))
+		assert.False(t, TagIDsMatch("", "04A1B2C3"))
+	})
+}
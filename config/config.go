@@ -0,0 +1,235 @@
+// Package config loads the piena configuration file.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/michaelkleinhenz/piena/base"
+)
+
+const (
+	// RoleAudiobook readers start the audiobook of a placed tag and stop it
+	// when the tag is removed.
+	RoleAudiobook = "audiobook"
+	// RoleControl readers do not start audiobooks.
+	RoleControl = "control"
+)
+
+// Removal policies, what happens when the tag of the playing audiobook is
+// removed.
+const (
+	// RemovalStop stops playback.
+	RemovalStop = "stop"
+	// RemovalPause pauses playback. Placing the tag again within the grace
+	// period resumes playback, afterwards playback is stopped.
+	RemovalPause = "pause"
+	// RemovalIgnore keeps playing.
+	RemovalIgnore = "ignore"
+)
+
+// Actions of command tags.
+const (
+	// ActionPause pauses and resumes playback.
+	ActionPause = "pause"
+	// ActionNext skips to the next chapter.
+	ActionNext = "next"
+	// ActionPrevious skips to the previous chapter.
+	ActionPrevious = "previous"
+	// ActionRestart starts the current audiobook from the first chapter.
+	ActionRestart = "restart"
+	// ActionVolumeUp raises the volume by the step of the command.
+	ActionVolumeUp = "volumeup"
+	// ActionVolumeDown lowers the volume by the step of the command.
+	ActionVolumeDown = "volumedown"
+	// ActionSleep pauses playback after the duration of the command.
+	ActionSleep = "sleep"
+	// ActionShuffle shuffles the tracklist.
+	ActionShuffle = "shuffle"
+)
+
+const (
+	// defaultVolumeStep is the volume step of volume commands.
+	defaultVolumeStep = 10
+	// defaultSleepDuration is the duration of sleep commands.
+	defaultSleepDuration = 15 * time.Minute
+	// DefaultRemovalGracePeriod is the grace period of RemovalPause.
+	DefaultRemovalGracePeriod = time.Minute
+)
+
+var actions = map[string]bool{
+	ActionPause:      true,
+	ActionNext:       true,
+	ActionPrevious:   true,
+	ActionRestart:    true,
+	ActionVolumeUp:   true,
+	ActionVolumeDown: true,
+	ActionSleep:      true,
+	ActionShuffle:    true,
+}
+
+// Config is the piena configuration.
+type Config struct {
+	// Readers are the tag readers, each with its own behavior.
+	Readers []Reader `json:"readers"`
+	// Commands are the tags controlling playback instead of starting an
+	// audiobook.
+	Commands []Command `json:"commands"`
+	// RemovalPolicy is what happens when a tag is removed, defaults to
+	// RemovalStop.
+	RemovalPolicy string `json:"removalPolicy"`
+	// RemovalGracePeriod is the time a paused audiobook is resumed when its
+	// tag is placed again, defaults to one minute.
+	RemovalGracePeriod Duration `json:"removalGracePeriod"`
+}
+
+// Command maps a tag to a playback action.
+type Command struct {
+	// ID is the tag ID.
+	ID string `json:"id"`
+	// Action is the action of the tag, e.g. ActionPause.
+	Action string `json:"action"`
+	// Step is the volume change of volume actions, defaults to 10.
+	Step int `json:"step"`
+	// Duration is the time until playback is paused of sleep actions,
+	// defaults to 15 minutes.
+	Duration Duration `json:"duration"`
+}
+
+// Reader configures a tag reader.
+type Reader struct {
+	// Name identifies the reader in logs and events, defaults to the device
+	// or, without device, to the source.
+	Name string `json:"name"`
+	// Source is the tag source: libnfc, pn532, hid, serial or stdin.
+	Source string `json:"source"`
+	// Device is the device of the source, e.g. the libnfc connection
+	// string or /dev/ttyUSB0.
+	Device string `json:"device"`
+	// BaudRate is the baud rate of serial and pn532 sources.
+	BaudRate int `json:"baudRate"`
+	// RemovalTimeout is the time after the last reading a tag counts as
+	// removed for hid and serial sources, e.g. "1s". Without timeout, the
+	// removal of a tag is never reported.
+	RemovalTimeout Duration `json:"removalTimeout"`
+	// Role is what tags placed on the reader do, defaults to
+	// RoleAudiobook.
+	Role string `json:"role"`
+	// PresentDebounce is the time a new tag has to be read before it is
+	// used, nil for the default.
+	PresentDebounce *Duration `json:"presentDebounce"`
+	// AbsentDebounce is the time a tag has to be missing before it counts
+	// as removed, nil for the default.
+	AbsentDebounce *Duration `json:"absentDebounce"`
+}
+
+// Duration is a duration given as string like "1s" or "500ms".
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON parses the duration string.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("invalid duration %s, expected a string like \"1s\"", string(data))
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// MarshalJSON returns the duration string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
+
+// Load reads the configuration file and sets the defaults.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse parses the configuration and sets the defaults.
+func Parse(data []byte) (*Config, error) {
+	config := new(Config)
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %s", err.Error())
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate checks the configuration and sets the defaults.
+func (config *Config) Validate() error {
+	names := map[string]bool{}
+	for idx := range config.Readers {
+		reader := &config.Readers[idx]
+		if reader.Source == "" {
+			return fmt.Errorf("invalid configuration: no source given for reader %d", idx+1)
+		}
+		if reader.Name == "" {
+			reader.Name = reader.Device
+		}
+		if reader.Name == "" {
+			reader.Name = reader.Source
+		}
+		if names[reader.Name] {
+			return fmt.Errorf("invalid configuration: duplicate reader name %s", reader.Name)
+		}
+		names[reader.Name] = true
+		switch reader.Role {
+		case "":
+			reader.Role = RoleAudiobook
+		case RoleAudiobook, RoleControl:
+		default:
+			return fmt.Errorf("invalid configuration: unknown role %s of reader %s", reader.Role, reader.Name)
+		}
+	}
+	switch config.RemovalPolicy {
+	case "":
+		config.RemovalPolicy = RemovalStop
+	case RemovalStop, RemovalPause, RemovalIgnore:
+	default:
+		return fmt.Errorf("invalid configuration: unknown removal policy %s", config.RemovalPolicy)
+	}
+	if config.RemovalGracePeriod.Duration <= 0 {
+		config.RemovalGracePeriod.Duration = DefaultRemovalGracePeriod
+	}
+	for idx := range config.Commands {
+		command := &config.Commands[idx]
+		if command.ID == "" {
+			return fmt.Errorf("invalid configuration: no id given for command %d", idx+1)
+		}
+		if !actions[command.Action] {
+			return fmt.Errorf("invalid configuration: unknown action %s of command %s", command.Action, command.ID)
+		}
+		if command.Step <= 0 {
+			command.Step = defaultVolumeStep
+		}
+		if command.Duration.Duration <= 0 {
+			command.Duration.Duration = defaultSleepDuration
+		}
+	}
+	return nil
+}
+
+// Command returns the command of the tag, nil if the tag is no command tag.
+func (config *Config) Command(id string) *Command {
+	for idx := range config.Commands {
+		if base.TagIDsMatch(config.Commands[idx].ID, id) {
+			return &config.Commands[idx]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	file, err := ioutil.TempFile("", "piena-config-")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(`{
+		"readers": [
+			{"source": "libnfc", "device": "pn532_uart:/dev/ttyUSB0"},
+			{"name": "control", "source": "serial", "device": "/dev/ttyUSB1", "baudRate": 9600, "removalTimeout": "1s", "role": "control"},
+			{"source": "stdin", "absentDebounce": "0s"}
+		]
+	}`)
+	require.NoError(t, err)
+	file.Close()
+	config, err := Load(file.Name())
+	require.NoError(t, err)
+	require.Len(t, config.Readers, 3)
+	assert.Equal(t, Reader{Name: "pn532_uart:/dev/ttyUSB0", Source: "libnfc", Device: "pn532_uart:/dev/ttyUSB0", Role: RoleAudiobook}, config.Readers[0])
+	assert.Equal(t, "control", config.Readers[1].Name)
+	assert.Equal(t, RoleControl, config.Readers[1].Role)
+	assert.Equal(t, 9600, config.Readers[1].BaudRate)
+	assert.Equal(t, time.Second, config.Readers[1].RemovalTimeout.Duration)
+	assert.Equal(t, "stdin", config.Readers[2].Name)
+	assert.Nil(t, config.Readers[1].AbsentDebounce)
+	require.NotNil(t, config.Readers[2].AbsentDebounce)
+	assert.Equal(t, time.Duration(0), config.Readers[2].AbsentDebounce.Duration)
+	assert.Equal(t, RemovalStop, config.RemovalPolicy)
+	assert.Equal(t, DefaultRemovalGracePeriod, config.RemovalGracePeriod.Duration)
+	_, err = Load(file.Name() + ".missing")
+	assert.Error(t, err)
+}
+
+func TestCommands(t *testing.T) {
+	config, err := Parse([]byte(`{
+		"commands": [
+			{"id": "04:a1:b2:c3", "action": "pause"},
+			{"id": "0x04a1b2c4", "action": "volumeup", "step": 5},
+			{"id": "04A1B2C5", "action": "sleep"},
+			{"id": "04A1B2C6", "action": "sleep", "duration": "30m"}
+		]
+	}`))
+	require.NoError(t, err)
+	command := config.Command("04A1B2C3")
+	require.NotNil(t, command)
+	assert.Equal(t, ActionPause, command.Action)
+	assert.Equal(t, 5, config.Command("04a1b2c4").Step)
+	assert.Equal(t, 15*time.Minute, config.Command("04A1B2C5").Duration.Duration)
+	assert.Equal(t, 30*time.Minute, config.Command("04A1B2C6").Duration.Duration)
+	assert.Nil(t, config.Command("04A1B2C7"))
+}
+
+func TestRemovalPolicy(t *testing.T) {
+	config, err := Parse([]byte(`{"removalPolicy": "pause", "removalGracePeriod": "5m"}`))
+	require.NoError(t, err)
+	assert.Equal(t, RemovalPause, config.RemovalPolicy)
+	assert.Equal(t, 5*time.Minute, config.RemovalGracePeriod.Duration)
+}
+
+func TestParseInvalid(t *testing.T) {
+	testCases := map[string]string{
+		"syntax":         `{"readers": [`,
+		"no source":      `{"readers": [{"device": "/dev/ttyUSB0"}]}`,
+		"duplicate name": `{"readers": [{"source": "serial", "device": "/dev/ttyUSB0"}, {"source": "hid", "device": "/dev/ttyUSB0"}]}`,
+		"unknown role":   `{"readers": [{"source": "stdin", "role": "dj"}]}`,
+		"duration":       `{"readers": [{"source": "serial", "removalTimeout": 1000}]}`,
+		"command id":     `{"commands": [{"action": "pause"}]}`,
+		"unknown action": `{"commands": [{"id": "04A1B2C3", "action": "dance"}]}`,
+		"removal policy": `{"removalPolicy": "eject"}`,
+	}
+	for name, data := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse([]byte(data))
+			assert.Error(t, err)
+		})
+	}
+}
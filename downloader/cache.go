@@ -0,0 +1,154 @@
+package downloader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// cacheMetadataSuffix is appended to the name of a cached file to get
+	// the name of its metadata file.
+	cacheMetadataSuffix = ".meta.json"
+	// cachePartialSuffix is appended to the name of a cached file while it
+	// is downloaded.
+	cachePartialSuffix = ".part"
+	// maxCacheAge is the time after which cached files that were not fetched
+	// again are removed. The directory is never removed, it is needed as
+	// offline fallback.
+	maxCacheAge = 30 * 24 * time.Hour
+	// minLeftoverTempDirAge is the age of temp directories of previous
+	// versions before they are removed, younger ones may still be in use
+	// by another running piena.
+	minLeftoverTempDirAge = 24 * time.Hour
+)
+
+// tempDirPattern matches the temp directories created by previous versions
+// for caching downloads.
+var tempDirPattern = regexp.MustCompile("^piena[0-9]+$")
+
+// cacheEntry is the metadata stored next to a cached file.
+type cacheEntry struct {
+	URL       string    `json:"url"`
+	FetchedAt time.Time `json:"fetchedAt"`
+	ETag      string    `json:"etag,omitempty"`
+}
+
+// initCache creates the cache directory, removes stale entries and removes
+// temp directories left over by previous versions. If no cache directory is
+// given, the piena directory in the user cache directory is used.
+func (c *Downloader) initCache(cacheDir string) error {
+	if cacheDir == "" {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return err
+		}
+		cacheDir = filepath.Join(userCacheDir, "piena")
+	}
+	log.Printf("[downloader] using cache directory %s", cacheDir)
+	err := os.MkdirAll(cacheDir, 0755)
+	if err != nil {
+		return err
+	}
+	c.cacheDir = cacheDir
+	removeLeftoverTempDirs()
+	return c.cleanupCache()
+}
+
+// cachePath returns the path of the cached file for the given URL.
+func (c *Downloader) cachePath(url string) string {
+	return filepath.Join(c.cacheDir, c.hashURL(url))
+}
+
+// readCacheEntry returns the metadata of the cached file for the given URL,
+// or nil if the URL is not cached.
+func (c *Downloader) readCacheEntry(url string) *cacheEntry {
+	cachedPath := c.cachePath(url)
+	if !c.checkExistence(cachedPath) {
+		return nil
+	}
+	entry, err := readCacheMetadata(cachedPath + cacheMetadataSuffix)
+	if err != nil || entry.URL != url {
+		return nil
+	}
+	return entry
+}
+
+// writeCacheEntry stores the metadata of a freshly fetched file.
+func (c *Downloader) writeCacheEntry(url string, etag string) error {
+	entry := cacheEntry{URL: url, FetchedAt: time.Now(), ETag: etag}
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.cachePath(url)+cacheMetadataSuffix, entryBytes, 0644)
+}
+
+// removeCacheEntry removes the cached file for the given URL.
+func (c *Downloader) removeCacheEntry(url string) {
+	cachedPath := c.cachePath(url)
+	c.deleteFile(cachedPath)
+	c.deleteFile(cachedPath + cacheMetadataSuffix)
+}
+
+// cleanupCache removes cached files that were not fetched within
+// maxCacheAge, files without metadata and partial downloads.
+func (c *Downloader) cleanupCache() error {
+	files, err := ioutil.ReadDir(c.cacheDir)
+	if err != nil {
+		return err
+	}
+	keep := map[string]bool{}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), cacheMetadataSuffix) {
+			continue
+		}
+		entry, err := readCacheMetadata(filepath.Join(c.cacheDir, file.Name()))
+		if err == nil && (strings.HasPrefix(entry.URL, c.directoryURL) || time.Since(entry.FetchedAt) < maxCacheAge) {
+			keep[file.Name()] = true
+			keep[strings.TrimSuffix(file.Name(), cacheMetadataSuffix)] = true
+		}
+	}
+	for _, file := range files {
+		if keep[file.Name()] || file.IsDir() {
+			continue
+		}
+		log.Printf("[downloader] removing stale cache file %s", file.Name())
+		os.Remove(filepath.Join(c.cacheDir, file.Name()))
+	}
+	return nil
+}
+
+func readCacheMetadata(path string) (*cacheEntry, error) {
+	entryBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entry := new(cacheEntry)
+	err = json.Unmarshal(entryBytes, entry)
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// removeLeftoverTempDirs removes the temp directories previous versions
+// created on every start, once they were not modified for
+// minLeftoverTempDirAge.
+func removeLeftoverTempDirs() {
+	files, err := ioutil.ReadDir(os.TempDir())
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() && tempDirPattern.MatchString(file.Name()) && time.Since(file.ModTime()) > minLeftoverTempDirAge {
+			log.Printf("[downloader] removing leftover temp directory %s", file.Name())
+			os.RemoveAll(filepath.Join(os.TempDir(), file.Name()))
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache(t *testing.T) {
+	path, err := ioutil.TempDir("", "piena-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(path)
+	// leftover temp directories are searched in the temp dir.
+	oldTempDir := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", path)
+	defer os.Setenv("TMPDIR", oldTempDir)
+	cacheDir := filepath.Join(path, "cache")
+	directoryContent := `{"schemaVersion":1,"id":"testDirectory","books":[{"id":"book1","artist":"aa","title":"ta","archiveFile":"ta.zip"}]}`
+	downloads := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", "\"1\"")
+		if r.Header.Get("If-None-Match") == "\"1\"" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Write([]byte(directoryContent))
+	}))
+	directoryURL := ts.URL + "/directory.json"
+	t.Run("storing metadata", func(t *testing.T) {
+		downloader, err := NewDownloader(path, directoryURL, cacheDir)
+		assert.NoError(t, err)
+		cachedPath, err := downloader.downloadFile(context.Background(), directoryURL)
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(cacheDir, downloader.hashURL(directoryURL)), cachedPath)
+		entry := downloader.readCacheEntry(directoryURL)
+		assert.NotNil(t, entry)
+		assert.Equal(t, directoryURL, entry.URL)
+		assert.Equal(t, "\"1\"", entry.ETag)
+		assert.WithinDuration(t, time.Now(), entry.FetchedAt, time.Minute)
+	})
+	t.Run("revalidating with etag", func(t *testing.T) {
+		downloader, err := NewDownloader(path, directoryURL, cacheDir)
+		assert.NoError(t, err)
+		id, err := downloader.GetID("aa", "ta")
+		assert.NoError(t, err)
+		assert.Equal(t, "book1", id)
+		assert.Equal(t, 1, downloads)
+	})
+	t.Run("using cache after restart while offline", func(t *testing.T) {
+		ts.Close()
+		downloader, err := NewDownloader(path, directoryURL, cacheDir)
+		assert.NoError(t, err)
+		id, err := downloader.GetID("aa", "ta")
+		assert.NoError(t, err)
+		assert.Equal(t, "book1", id)
+	})
+	t.Run("removing stale entries", func(t *testing.T) {
+		staleURL := "http://example.com/stale.zip"
+		downloader, err := NewDownloader(path, directoryURL, cacheDir)
+		assert.NoError(t, err)
+		stalePath := downloader.cachePath(staleURL)
+		assert.NoError(t, ioutil.WriteFile(stalePath, []byte("stale"), 0644))
+		entryBytes, _ := json.Marshal(cacheEntry{URL: staleURL, FetchedAt: time.Now().Add(-2 * maxCacheAge)})
+		assert.NoError(t, ioutil.WriteFile(stalePath+cacheMetadataSuffix, entryBytes, 0644))
+		orphanPath := filepath.Join(cacheDir, "orphan")
+		assert.NoError(t, ioutil.WriteFile(orphanPath, []byte("orphan"), 0644))
+		leftoverDir := filepath.Join(path, "piena123456")
+		assert.NoError(t, os.Mkdir(leftoverDir, 0755))
+		leftoverTime := time.Now().Add(-2 * minLeftoverTempDirAge)
+		assert.NoError(t, os.Chtimes(leftoverDir, leftoverTime, leftoverTime))
+		// recent temp directories may be in use by another piena.
+		recentDir := filepath.Join(path, "piena654321")
+		assert.NoError(t, os.Mkdir(recentDir, 0755))
+		_, err = NewDownloader(path, directoryURL, cacheDir)
+		assert.NoError(t, err)
+		assert.NoFileExists(t, stalePath)
+		assert.NoFileExists(t, stalePath+cacheMetadataSuffix)
+		assert.NoFileExists(t, orphanPath)
+		assert.NoDirExists(t, leftoverDir)
+		assert.DirExists(t, recentDir)
+		assert.DirExists(t, cacheDir)
+		// the directory is kept as offline fallback regardless of its age.
+		assert.FileExists(t, downloader.cachePath(directoryURL))
+	})
+}
@@ -2,8 +2,9 @@ package downloader
 
 import (
 	"archive/zip"
+	"context"
+	"crypto/ed25519"
 	"crypto/sha1"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -13,6 +14,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/michaelkleinhenz/piena/base"
 )
@@ -21,62 +23,62 @@ import (
 type Downloader struct {
 	libraryPath string
 	directoryURL string
-	tempDir string
+	cacheDir string
 	directory *base.AudiobookDirectory
+	publicKey ed25519.PublicKey
 }
 
-// NewDownloader returns a new downloader instance.
-func NewDownloader(libraryPath string, directoryURL string) (*Downloader, error) {
+// NewDownloader returns a new downloader instance. Downloads are cached in
+// the given cache directory, which defaults to the user cache directory if
+// empty.
+func NewDownloader(libraryPath string, directoryURL string, cacheDir string) (*Downloader, error) {
 	downloader := new(Downloader)
 	downloader.libraryPath = libraryPath
 	downloader.directoryURL = directoryURL
-	var err error
-	downloader.tempDir, err = ioutil.TempDir("", "piena")
+	err := downloader.initCache(cacheDir)
 	if err != nil {
 		return nil, err
 	}
 	return downloader, nil
 }
 
+// SetPublicKey sets the key the directory signature is verified with. If a
+// key is set, unsigned or badly signed directories are refused.
+func (c *Downloader) SetPublicKey(key ed25519.PublicKey) {
+	c.publicKey = key
+}
+
 // GetAudiobook checks if the audiobook with the given ID is already
 // available and (if not) fetches it from the server. Returns nil
-// if audiobook is downloaded and available.
-func (c *Downloader) GetAudiobook(ID string) (*base.Audiobook, bool, error) {
+// if audiobook is downloaded and available. Downloads are aborted when the
+// context is done.
+func (c *Downloader) GetAudiobook(ctx context.Context, ID string) (*base.Audiobook, bool, error) {
 	log.Printf("[downloader] retrieving audiobook %s", ID)
-	directoryPath, err := c.downloadFile(c.directoryURL)
-	if err != nil && c.directory == nil {
+	directory, err := c.loadDirectory(ctx)
+	if err != nil {
 		return nil, false, err
 	}
-	directory, err := c.unmarshallDirectoryFile(directoryPath)
+	entry := c.findAudiobook(directory, ID)
+	if entry == nil {
+		return nil, false, errors.New("audiobook id not found in directory: " + ID)
+	}
+	isExisting, err := c.isAudiobookAlreadyExisting(entry)
 	if err != nil {
 		return nil, false, err
 	}
-	for _, entry := range directory.Books {
-		if strings.HasPrefix(ID, entry.ID) {
-			isExisting, err := c.isAudiobookAlreadyExisting(&entry)
-			if err != nil {
-				return nil, false, err
-			}
-			if isExisting {
-				return &entry, true, nil
-			}
-			err = c.downloadAudiobook(&entry, directory.BaseURL)
-			if err != nil {
-				return nil, false, err
-			}
-			return &entry, false, nil
-		}
+	if isExisting {
+		return entry, true, nil
+	}
+	err = c.downloadAudiobook(ctx, entry, directory.BaseURL)
+	if err != nil {
+		return nil, false, err
 	}
-	return nil, false, errors.New("audiobook id not found in directory: " + ID)
+	return entry, false, nil
 }
 
 // GetID retrieves the ID for a given set of artist and title.
 func (c *Downloader) GetID(artist string, title string) (string, error) {
-	directoryPath, err := c.downloadFile(c.directoryURL)
-	if err != nil && c.directory == nil {
-		return "", err
-	}
-	directory, err := c.unmarshallDirectoryFile(directoryPath)
+	directory, err := c.loadDirectory(context.Background())
 	if err != nil {
 		return "", err
 	}
@@ -90,14 +92,93 @@ func (c *Downloader) GetID(artist string, title string) (string, error) {
 	return "", errors.New("audiobook not found in directory")
 }
 
-func (c *Downloader) downloadAudiobook(audiobook *base.Audiobook, baseURL string) error {
+// GetCoverURL returns the URL of the cover image for the audiobook with the
+// given ID. Returns an empty string if the audiobook has no cover image.
+func (c *Downloader) GetCoverURL(ID string) (string, error) {
+	directory, err := c.loadDirectory(context.Background())
+	if err != nil {
+		return "", err
+	}
+	audiobook := c.findAudiobook(directory, ID)
+	if audiobook == nil {
+		return "", errors.New("audiobook id not found in directory: " + ID)
+	}
+	if audiobook.CoverImage == "" {
+		return "", nil
+	}
+	return directory.BaseURL + audiobook.CoverImage, nil
+}
+
+// GetNextInSeries returns the audiobook following the audiobook with the
+// given ID in its series. Returns nil if the audiobook is not part of a
+// series or is the last one of its series.
+func (c *Downloader) GetNextInSeries(ID string) (*base.Audiobook, error) {
+	directory, err := c.loadDirectory(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	current := c.findAudiobook(directory, ID)
+	if current == nil {
+		return nil, errors.New("audiobook id not found in directory: " + ID)
+	}
+	if current.Series == "" {
+		return nil, nil
+	}
+	var next *base.Audiobook
+	for idx := range directory.Books {
+		entry := &directory.Books[idx]
+		if entry.Series != current.Series || entry.SeriesIndex <= current.SeriesIndex {
+			continue
+		}
+		if next == nil || entry.SeriesIndex < next.SeriesIndex {
+			next = entry
+		}
+	}
+	if next != nil {
+		log.Printf("[downloader] next audiobook in series %s after %s is %s", current.Series, current.ID, next.ID)
+	}
+	return next, nil
+}
+
+// loadDirectory fetches the directory, falling back to the last valid
+// directory if it can not be fetched or is invalid.
+func (c *Downloader) loadDirectory(ctx context.Context) (*base.AudiobookDirectory, error) {
+	directoryPath, err := c.downloadFile(ctx, c.directoryURL)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err == nil {
+		var directory *base.AudiobookDirectory
+		directory, err = c.unmarshallDirectoryFile(ctx, directoryPath)
+		if err == nil {
+			return directory, nil
+		}
+	}
+	if c.directory == nil {
+		return nil, err
+	}
+	log.Printf("[downloader] loading directory failed, using last valid directory: %s", err.Error())
+	return c.directory, nil
+}
+
+// findAudiobook returns the directory entry matching the given ID.
+func (c *Downloader) findAudiobook(directory *base.AudiobookDirectory, ID string) *base.Audiobook {
+	for idx := range directory.Books {
+		if base.TagIDsMatch(ID, directory.Books[idx].ID) {
+			return &directory.Books[idx]
+		}
+	}
+	return nil
+}
+
+func (c *Downloader) downloadAudiobook(ctx context.Context, audiobook *base.Audiobook, baseURL string) error {
 	log.Printf("[downloader] downloading %s", audiobook.ID)
 	audiobookPath, err := c.getAudiobookPath(audiobook)
 	if err != nil {
 		return err
 	}
-	archivePath, err := c.downloadFile(baseURL + audiobook.ArchiveFile)
-	defer c.deleteFile(archivePath)
+	archivePath, err := c.downloadFile(ctx, baseURL+audiobook.ArchiveFile)
+	defer c.removeCacheEntry(baseURL + audiobook.ArchiveFile)
 	if err != nil {
 		return err
 	}
@@ -169,20 +250,52 @@ func (c *Downloader) checkExistence(filepath string) bool {
 	return false
 }
 
-func (c *Downloader) unmarshallDirectoryFile(filepath string) (*base.AudiobookDirectory, error) {
+func (c *Downloader) unmarshallDirectoryFile(ctx context.Context, filepath string) (*base.AudiobookDirectory, error) {
 	log.Printf("[downloader] unmarshalling %s", filepath)
 	jsonFile, err := os.Open(filepath)
 	if err != nil {
 		return nil, err
 	}
 	defer jsonFile.Close()
-	byteValue, _ := ioutil.ReadAll(jsonFile)
-	directory := new(base.AudiobookDirectory)
-	json.Unmarshal(byteValue, directory)
+	byteValue, err := ioutil.ReadAll(jsonFile)
+	if err != nil {
+		return nil, err
+	}
+	err = c.verifyDirectory(ctx, byteValue)
+	if err != nil {
+		return nil, err
+	}
+	directory, err := base.ParseDirectory(byteValue)
+	if err != nil {
+		return nil, err
+	}
 	c.directory = directory
 	return directory, nil
 }
 
+// verifyDirectory checks the detached signature of the directory content
+// if a public key is set. The signature is fetched on every check, so a
+// tampered cached directory is refused as well.
+func (c *Downloader) verifyDirectory(ctx context.Context, directoryBytes []byte) error {
+	if c.publicKey == nil {
+		return nil
+	}
+	signaturePath, err := c.downloadFile(ctx, c.directoryURL+base.SignatureSuffix)
+	if err != nil {
+		return fmt.Errorf("directory is not signed: %v", err)
+	}
+	signature, err := ioutil.ReadFile(signaturePath)
+	if err != nil {
+		return fmt.Errorf("directory is not signed: %v", err)
+	}
+	err = base.VerifyDirectory(directoryBytes, signature, c.publicKey)
+	if err != nil {
+		return err
+	}
+	log.Println("[downloader] directory signature verified")
+	return nil
+}
+
 func (c *Downloader) createDirectory(path string) error {
 	log.Printf("[downloader] creating directory %s", path)
 	return os.MkdirAll(path, 0755)
@@ -205,34 +318,69 @@ func (c *Downloader) hashURL(url string) string {
 	return fmt.Sprintf("%x", bs)
 }
 
-// DownloadFile will download a url to a temporary local file.
-func (c *Downloader) downloadFile(url string) (string, error) {
-	hashedFilename := c.hashURL(url)
-	tmpfn := filepath.Join(c.tempDir, hashedFilename)
+// downloadFile downloads a url to the cache and returns the path of the
+// cached file. A cached file with matching ETag is not downloaded again. If
+// the download fails, the cached file is used as fallback, unless the
+// download was aborted because the context is done.
+func (c *Downloader) downloadFile(ctx context.Context, url string) (string, error) {
+	cachedPath := c.cachePath(url)
+	entry := c.readCacheEntry(url)
 	log.Printf("[downloader] downloading from %s", url)
 	client := &http.Client{}
 	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
 	req.SetBasicAuth(os.Getenv("PIENA_USER"), os.Getenv("PIENA_PASS"))
+	if entry != nil && entry.ETag != "" {
+		req.Header.Set("If-None-Match", entry.ETag)
+	}
 	resp, err := client.Do(req)
-	if err != nil || resp.StatusCode != 200 {
+	if ctx.Err() != nil {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return "", ctx.Err()
+	}
+	if err == nil && resp.StatusCode == http.StatusNotModified && entry != nil {
+		resp.Body.Close()
+		log.Printf("[downloader] %s not modified, using cached version at %s", url, cachedPath)
+		return cachedPath, c.writeCacheEntry(url, entry.ETag)
+	}
+	if err != nil || resp.StatusCode != http.StatusOK {
 		// error, we try to get a cached version
 		log.Printf("[downloader] downloading %s failed, trying to use a cached version of the file", url)
-		if c.checkExistence(tmpfn) {
-			log.Printf("[downloader] returning cached version for %s found at %s", url, tmpfn)
-			return tmpfn, nil
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("downloading %s failed: %s", url, resp.Status)
+		}
+		if entry != nil {
+			log.Printf("[downloader] returning cached version for %s fetched at %s found at %s", url, entry.FetchedAt.Format(time.RFC3339), cachedPath)
+			return cachedPath, nil
 		}
 		return "", err
 	}
 	defer resp.Body.Close()
-	// write file to temp file that has the url hash as filename
-	log.Printf("[downloader] downloading to %s", tmpfn)
-	out, err := os.Create(tmpfn)
+	// download to a partial file first, so an interrupted download does
+	// not replace the cached version.
+	log.Printf("[downloader] downloading to %s", cachedPath)
+	partialPath := cachedPath + cachePartialSuffix
+	out, err := os.Create(partialPath)
 	if err != nil {
 		return "", err
-	}	
-	defer out.Close()
+	}
 	_, err = io.Copy(out, resp.Body)
-	return out.Name(), err
+	out.Close()
+	if err != nil {
+		os.Remove(partialPath)
+		return "", err
+	}
+	err = os.Rename(partialPath, cachedPath)
+	if err != nil {
+		return "", err
+	}
+	return cachedPath, c.writeCacheEntry(url, resp.Header.Get("ETag"))
 }
 
 func (c *Downloader) unzip(src string, dest string) ([]string, error) {
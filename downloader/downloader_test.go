@@ -3,12 +3,14 @@ package downloader
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -63,29 +65,75 @@ func TestDownloader(t *testing.T) {
         }
 	}))
 	defer ts.Close()
-	directory.BaseURL = ts.URL
+	directory.BaseURL = ts.URL + "/"
 	// start test
-	downloader, err := NewDownloader(path, ts.URL + "/directory.json")
+	downloader, err := NewDownloader(path, ts.URL + "/directory.json", path + "/cache")
 	assert.NoError(t, err)
-	audiobook, _, err := downloader.GetAudiobook("testBook")
+	audiobook, _, err := downloader.GetAudiobook(context.Background(), "testBook")
 	assert.NoError(t, err)
 	assert.NotNil(t, audiobook)
 	// check if book is available
-	assert.DirExists(t, path + "/" + directory.Books[0].Title)
+	assert.DirExists(t, path + "/" + directory.Books[0].Artist + "/" + directory.Books[0].Title)
 	for _, entry := range directory.Books[0].Tracks {
-			assert.FileExists(t, path + "/" + directory.Books[0].Title + "/" + entry.Filename)
+			assert.FileExists(t, path + "/" + directory.Books[0].Artist + "/" + directory.Books[0].Title + "/" + entry.Filename)
 	}
 	// download it again
-	audiobook, _, err = downloader.GetAudiobook("testBook")
+	audiobook, _, err = downloader.GetAudiobook(context.Background(), "testBook")
 	assert.NoError(t, err)
 	assert.NotNil(t, audiobook)
 	// check if book is available
-	assert.DirExists(t, path + "/" + directory.Books[0].Title)
+	assert.DirExists(t, path + "/" + directory.Books[0].Artist + "/" + directory.Books[0].Title)
 	for _, entry := range directory.Books[0].Tracks {
-			assert.FileExists(t, path + "/" + directory.Books[0].Title + "/" + entry.Filename)
+			assert.FileExists(t, path + "/" + directory.Books[0].Artist + "/" + directory.Books[0].Title + "/" + entry.Filename)
 	}
 }
 
+func TestSeries(t *testing.T) {
+	path, err := ioutil.TempDir("", "piena-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(path)
+	directory := base.AudiobookDirectory{
+		ID:      "testDirectory",
+		BaseURL: "http://example.com/",
+		Books: []base.Audiobook{
+			base.Audiobook{ID: "book3", Series: "Test Series", SeriesIndex: 3},
+			base.Audiobook{ID: "book1", Series: "Test Series", SeriesIndex: 1, CoverImage: "book1.jpg"},
+			base.Audiobook{ID: "other", Series: "Other Series", SeriesIndex: 2},
+			base.Audiobook{ID: "book2", Series: "Test Series", SeriesIndex: 2},
+			base.Audiobook{ID: "single"},
+		},
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		directoryBytes, _ := json.Marshal(directory)
+		w.Write(directoryBytes)
+	}))
+	defer ts.Close()
+	downloader, err := NewDownloader(path, ts.URL + "/directory.json", path + "/cache")
+	assert.NoError(t, err)
+	// next in series
+	next, err := downloader.GetNextInSeries("book1")
+	assert.NoError(t, err)
+	assert.Equal(t, "book2", next.ID)
+	next, err = downloader.GetNextInSeries("book2")
+	assert.NoError(t, err)
+	assert.Equal(t, "book3", next.ID)
+	next, err = downloader.GetNextInSeries("book3")
+	assert.NoError(t, err)
+	assert.Nil(t, next)
+	next, err = downloader.GetNextInSeries("single")
+	assert.NoError(t, err)
+	assert.Nil(t, next)
+	_, err = downloader.GetNextInSeries("unknown")
+	assert.Error(t, err)
+	// cover image
+	coverURL, err := downloader.GetCoverURL("book1")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://example.com/book1.jpg", coverURL)
+	coverURL, err = downloader.GetCoverURL("book2")
+	assert.NoError(t, err)
+	assert.Equal(t, "", coverURL)
+}
+
 func checkExistence(filepath string) bool {
 	if _, err := os.Stat(filepath); err == nil {
 		return true
@@ -117,3 +165,119 @@ func createDummyZipFile(files []string, zipfile string) error {
 	return nil
 }
 
+func TestInvalidDirectory(t *testing.T) {
+	path, err := ioutil.TempDir("", "piena-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(path)
+	directoryContent := `{"schemaVersion":1,"id":"testDirectory","books":[{"id":"book1","artist":"aa","title":"ta","archiveFile":"ta.zip"}]}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(directoryContent))
+	}))
+	defer ts.Close()
+	// ids are compared in their canonical form
+	directoryContent = `{"schemaVersion":1,"id":"testDirectory","books":[{"id":"0x04a1b2c3","artist":"aa","title":"ta","archiveFile":"ta.zip"}]}`
+	downloader, err := NewDownloader(path, ts.URL + "/directory.json", path + "/cache")
+	assert.NoError(t, err)
+	coverURL, err := downloader.GetCoverURL("04:A1:B2:C3")
+	assert.NoError(t, err)
+	assert.Equal(t, "", coverURL)
+	_, err = downloader.GetCoverURL("04A1B2")
+	assert.Error(t, err)
+	// invalid directory without previous valid directory
+	directoryContent = `{"id":"testDirectory","books":[`
+	downloader, err = NewDownloader(path, ts.URL + "/directory.json", path + "/cache2")
+	assert.NoError(t, err)
+	_, err = downloader.GetID("aa", "ta")
+	assert.Error(t, err)
+	// valid directory
+	directoryContent = `{"schemaVersion":1,"id":"testDirectory","books":[{"id":"book1","artist":"aa","title":"ta","archiveFile":"ta.zip"}]}`
+	id, err := downloader.GetID("aa", "ta")
+	assert.NoError(t, err)
+	assert.Equal(t, "book1", id)
+	// invalid directory falls back to last valid directory
+	directoryContent = `{"id":"testDirectory","books":{"id":"book1"}}`
+	id, err = downloader.GetID("aa", "ta")
+	assert.NoError(t, err)
+	assert.Equal(t, "book1", id)
+}
+
+func TestSignedDirectory(t *testing.T) {
+	path, err := ioutil.TempDir("", "piena-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(path)
+	privateKey, publicKey, err := base.GenerateSigningKey()
+	assert.NoError(t, err)
+	keyFile := path + "/signing.key"
+	assert.NoError(t, ioutil.WriteFile(keyFile, []byte(privateKey), 0600))
+	signingKey, err := base.LoadSigningKey(keyFile)
+	assert.NoError(t, err)
+	verifyKey, err := base.ParsePublicKey(publicKey)
+	assert.NoError(t, err)
+	directoryContent := []byte(`{"schemaVersion":1,"id":"testDirectory","books":[{"id":"book1","artist":"aa","title":"ta","archiveFile":"ta.zip"}]}`)
+	var signature []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/directory.json":
+			w.Write(directoryContent)
+		case "/directory.json" + base.SignatureSuffix:
+			if signature == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(signature)
+		}
+	}))
+	defer ts.Close()
+	t.Run("refusing unsigned directory", func(t *testing.T) {
+		downloader, err := NewDownloader(path, ts.URL + "/directory.json", path + "/cache")
+		assert.NoError(t, err)
+		downloader.SetPublicKey(verifyKey)
+		_, err = downloader.GetID("aa", "ta")
+		assert.Error(t, err)
+	})
+	t.Run("accepting signed directory", func(t *testing.T) {
+		signature = base.SignDirectory(directoryContent, signingKey)
+		downloader, err := NewDownloader(path, ts.URL + "/directory.json", path + "/cache")
+		assert.NoError(t, err)
+		downloader.SetPublicKey(verifyKey)
+		id, err := downloader.GetID("aa", "ta")
+		assert.NoError(t, err)
+		assert.Equal(t, "book1", id)
+	})
+	t.Run("refusing tampered directory", func(t *testing.T) {
+		signature = base.SignDirectory(directoryContent, signingKey)
+		directoryContent = []byte(`{"schemaVersion":1,"id":"testDirectory","books":[{"id":"book1","artist":"aa","title":"evil","archiveFile":"evil.zip"}]}`)
+		downloader, err := NewDownloader(path, ts.URL + "/directory.json", path + "/cache")
+		assert.NoError(t, err)
+		downloader.SetPublicKey(verifyKey)
+		_, err = downloader.GetID("aa", "evil")
+		assert.Error(t, err)
+	})
+}
+
+func TestCancelledDownload(t *testing.T) {
+	path, err := ioutil.TempDir("", "piena-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(path)
+	var directoryContent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/directory.json" {
+			w.Write([]byte(directoryContent))
+			return
+		}
+		// the archive download hangs until the client goes away.
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+	directoryContent = `{"schemaVersion":1,"id":"testDirectory","baseURL":"` + ts.URL + `/","books":[{"id":"book1","artist":"aa","title":"ta","archiveFile":"ta.zip","tracks":[{"ord":1,"title":"01","filename":"01.mp3"}]}]}`
+	downloader, err := NewDownloader(path, ts.URL + "/directory.json", path + "/cache")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err = downloader.GetAudiobook(ctx, "book1")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.False(t, checkExistence(path + "/aa/ta"))
+	// a cancelled directory download does not fall back to the cache.
+	_, _, err = downloader.GetAudiobook(ctx, "book1")
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
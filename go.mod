@@ -4,8 +4,10 @@ go 1.14
 
 require (
 	github.com/aws/aws-sdk-go v1.29.26
+	github.com/dhowden/tag v0.0.0-20200412032933-5d76b8eaae27
 	github.com/djimenez/iconv-go v0.0.0-20160305225143-8960e66bd3da // indirect
 	github.com/mikkyang/id3-go v0.0.0-20191012064224-2c6ab3bb1fbd
 	github.com/stretchr/testify v1.5.1
 	github.com/ybbus/jsonrpc v2.1.2+incompatible
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -1,8 +1,13 @@
 package mopidy
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net/http"
 	"os/exec"
+	"strings"
+	"time"
 
 	rpc "github.com/ybbus/jsonrpc"
 )
@@ -12,11 +17,37 @@ const (
 	PlaybackStateStopped = "stopped"
 	// PlaybackStatePlaying indicates playback is playing.
 	PlaybackStatePlaying = "playing"
+	// PlaybackStatePaused indicates playback is paused.
+	PlaybackStatePaused = "paused"
 )
 
+// requestTimeout is the maximum time of a single call.
+const requestTimeout = 10 * time.Second
+
+// RetryOptions configure how failed calls are retried.
+type RetryOptions struct {
+	// Attempts is the number of attempts of a call.
+	Attempts int
+	// InitialBackoff is the delay before the first retry. It is doubled
+	// with every retry, up to MaxBackoff.
+	InitialBackoff time.Duration
+	// MaxBackoff is the maximum delay between retries, also used when
+	// waiting for the player to become available.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryOptions are used by new clients.
+var DefaultRetryOptions = RetryOptions{
+	Attempts:       3,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+}
+
 // Client is the client for the audio service.
 type Client struct {
 	rpcClient rpc.RPCClient
+	retry     RetryOptions
+	ctx       context.Context
 }
 
 // Artist represents an artist.
@@ -59,17 +90,114 @@ type payloadTracklistAdd struct {
 	Uris []string `json:"uris"`
 }
 
-// NewClient returns a new client instance.
+type payloadVolume struct {
+	Volume int `json:"volume"`
+}
+
+type payloadSeek struct {
+	TimePosition int64 `json:"time_position"`
+}
+
+type payloadMute struct {
+	Mute bool `json:"mute"`
+}
+
+type payloadValue struct {
+	Value bool `json:"value"`
+}
+
+// NewClient returns a new client instance. Calls failing because the
+// player is not reachable are retried, see SetRetryOptions.
 func NewClient(url string) (*Client, error) {
 	client := new(Client)
-	client.rpcClient = rpc.NewClient(url)
+	client.rpcClient = rpc.NewClientWithOpts(url, &rpc.RPCClientOpts{HTTPClient: &http.Client{Timeout: requestTimeout}})
+	client.retry = DefaultRetryOptions
+	client.ctx = context.Background()
 	return client, nil
 }
 
+// SetRetryOptions sets how failed calls are retried.
+func (c *Client) SetRetryOptions(options RetryOptions) {
+	c.retry = options
+}
+
+// SetContext sets the context of the client. Once it is done, failed calls
+// are no longer retried.
+func (c *Client) SetContext(ctx context.Context) {
+	c.ctx = ctx
+}
+
+// call calls the method, retrying with backoff if the player is not
+// reachable. Errors returned by the player are not retried, and neither are
+// other transport errors like timeouts of calls changing the player, as the
+// player may have handled the call already.
+func (c *Client) call(method string, params ...interface{}) (*rpc.RPCResponse, error) {
+	backoff := c.retry.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		resp, err := c.rpcClient.Call(method, params...)
+		if err == nil {
+			if resp.Error != nil {
+				return nil, resp.Error
+			}
+			return resp, nil
+		}
+		if attempt >= c.retry.Attempts || !retryable(method, err) {
+			return nil, err
+		}
+		log.Printf("[player] calling %s failed, retrying in %s: %s", method, backoff, err.Error())
+		select {
+		case <-time.After(backoff):
+		case <-c.ctx.Done():
+			return nil, err
+		}
+		backoff = c.nextBackoff(backoff)
+	}
+}
+
+// retryable returns true if the call failing with the transport error can
+// be sent again. That is the case if the request was not sent because the
+// player was not reachable, or if the method does not change the player.
+// The jsonrpc client only keeps the message of transport errors.
+func retryable(method string, err error) bool {
+	message := err.Error()
+	if strings.Contains(message, "dial ") || strings.Contains(message, "connection refused") {
+		return true
+	}
+	name := method[strings.LastIndex(method, ".")+1:]
+	return strings.HasPrefix(name, "get_") || name == "search"
+}
+
+func (c *Client) nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > c.retry.MaxBackoff {
+		return c.retry.MaxBackoff
+	}
+	return backoff
+}
+
+// WaitUntilAvailable blocks until the player answers, waiting longer
+// between each attempt. Returns the error of the context if it is done
+// before.
+func (c *Client) WaitUntilAvailable(ctx context.Context) error {
+	backoff := c.retry.InitialBackoff
+	for {
+		_, err := c.rpcClient.Call("core.get_version")
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = c.nextBackoff(backoff)
+	}
+}
+
 // AudiobookAvailable queries the given data and returns if the album 
 // is known. Returns the number of tracks in the album.
 func (c *Client) AudiobookAvailable(artist string, album string) (bool, int, error) {
-	resp, err := c.rpcClient.Call("core.library.search", &payloadQuery{Query: payloadQueryAttributes{Artist: artist, Album: album}})
+	resp, err := c.call("core.library.search", &payloadQuery{Query: payloadQueryAttributes{Artist: artist, Album: album}})
 	if err != nil {
 		return false, -1, err
 	}
@@ -84,13 +212,13 @@ func (c *Client) AudiobookAvailable(artist string, album string) (bool, int, err
 // AddToTracklist adds the given track URIs to the tracklist.
 func (c *Client) AddToTracklist(tracks []string) error {
 	log.Printf("[player] adding to tracklist: %s", tracks)
-	_, err := c.rpcClient.Call("core.tracklist.add", &payloadTracklistAdd{tracks})
+	_, err := c.call("core.tracklist.add", &payloadTracklistAdd{tracks})
 	return err
 }
 
 // GetPlaybackState returns the current playback state.
 func (c *Client) GetPlaybackState() (string, error) {
-	resp, err := c.rpcClient.Call("core.playback.get_state")
+	resp, err := c.call("core.playback.get_state")
 	if err != nil {
 		return "", err
 	}
@@ -103,7 +231,7 @@ func (c *Client) GetPlaybackState() (string, error) {
 
 // GetCurrentTracklist returns the current tracklist.
 func (c *Client) GetCurrentTracklist() ([]Track, error) {
-	resp, err := c.rpcClient.Call("core.tracklist.get_tl_tracks")
+	resp, err := c.call("core.tracklist.get_tl_tracks")
 	if err != nil {
 		return nil, err
 	}
@@ -121,7 +249,7 @@ func (c *Client) GetCurrentTracklist() ([]Track, error) {
 
 // GetCurrentTrack returns the current track.
 func (c *Client) GetCurrentTrack() (*Track, error) {
-	resp, err := c.rpcClient.Call("core.playback.get_current_track")
+	resp, err := c.call("core.playback.get_current_track")
 	if err != nil {
 		return nil, err
 	}
@@ -139,25 +267,154 @@ func (c *Client) RefreshLibrary() error {
 	if err != nil {
 		return err
 	}
-	_, err = c.rpcClient.Call("core.library.refresh")
+	_, err = c.call("core.library.refresh")
 	return err
 }
 
 // ClearTracklist clears the current tracklist.
 func (c *Client) ClearTracklist() error {
-	_, err := c.rpcClient.Call("core.tracklist.clear")
+	_, err := c.call("core.tracklist.clear")
 	return err
 }
 
 // Play plays the current tracklist.
 func (c *Client) Play() error {
-	_, err := c.rpcClient.Call("core.playback.play")
+	_, err := c.call("core.playback.play")
 	return err
 }
 
 // Stop stops playback.
 func (c *Client) Stop() error {
-	_, err := c.rpcClient.Call("core.playback.stop")
+	_, err := c.call("core.playback.stop")
+	return err
+}
+
+// Pause pauses playback.
+func (c *Client) Pause() error {
+	_, err := c.call("core.playback.pause")
+	return err
+}
+
+// Resume resumes paused playback.
+func (c *Client) Resume() error {
+	_, err := c.call("core.playback.resume")
 	return err
 }
 
+// Next skips to the next track.
+func (c *Client) Next() error {
+	_, err := c.call("core.playback.next")
+	return err
+}
+
+// Previous skips to the previous track.
+func (c *Client) Previous() error {
+	_, err := c.call("core.playback.previous")
+	return err
+}
+
+// GetVolume returns the volume from 0 to 100.
+func (c *Client) GetVolume() (int, error) {
+	resp, err := c.call("core.mixer.get_volume")
+	if err != nil {
+		return -1, err
+	}
+	result, err := resp.GetInt()
+	if err != nil {
+		return -1, err
+	}
+	return int(result), nil
+}
+
+// SetVolume sets the volume from 0 to 100.
+func (c *Client) SetVolume(volume int) error {
+	_, err := c.call("core.mixer.set_volume", &payloadVolume{volume})
+	return err
+}
+
+// Seek seeks to the position in the current track.
+func (c *Client) Seek(position time.Duration) error {
+	resp, err := c.call("core.playback.seek", &payloadSeek{int64(position / time.Millisecond)})
+	if err != nil {
+		return err
+	}
+	ok, err := resp.GetBool()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("seeking to " + position.String() + " failed")
+	}
+	return nil
+}
+
+// GetTimePosition returns the position in the current track.
+func (c *Client) GetTimePosition() (time.Duration, error) {
+	resp, err := c.call("core.playback.get_time_position")
+	if err != nil {
+		return 0, err
+	}
+	result, err := resp.GetInt()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(result) * time.Millisecond, nil
+}
+
+// GetMute returns if the volume is muted.
+func (c *Client) GetMute() (bool, error) {
+	return c.getBool("core.mixer.get_mute")
+}
+
+// SetMute mutes or unmutes the volume.
+func (c *Client) SetMute(mute bool) error {
+	_, err := c.call("core.mixer.set_mute", &payloadMute{mute})
+	return err
+}
+
+// GetRepeat returns if the tracklist is repeated.
+func (c *Client) GetRepeat() (bool, error) {
+	return c.getBool("core.tracklist.get_repeat")
+}
+
+// SetRepeat sets if the tracklist is repeated after the last track.
+func (c *Client) SetRepeat(repeat bool) error {
+	_, err := c.call("core.tracklist.set_repeat", &payloadValue{repeat})
+	return err
+}
+
+// GetConsume returns if played tracks are removed from the tracklist.
+func (c *Client) GetConsume() (bool, error) {
+	return c.getBool("core.tracklist.get_consume")
+}
+
+// SetConsume sets if played tracks are removed from the tracklist.
+func (c *Client) SetConsume(consume bool) error {
+	_, err := c.call("core.tracklist.set_consume", &payloadValue{consume})
+	return err
+}
+
+// GetSingle returns if playback stops after the current track.
+func (c *Client) GetSingle() (bool, error) {
+	return c.getBool("core.tracklist.get_single")
+}
+
+// SetSingle sets if playback stops after the current track.
+func (c *Client) SetSingle(single bool) error {
+	_, err := c.call("core.tracklist.set_single", &payloadValue{single})
+	return err
+}
+
+func (c *Client) getBool(method string) (bool, error) {
+	resp, err := c.call(method)
+	if err != nil {
+		return false, err
+	}
+	return resp.GetBool()
+}
+
+// Shuffle shuffles the tracklist.
+func (c *Client) Shuffle() error {
+	_, err := c.call("core.tracklist.shuffle")
+	return err
+}
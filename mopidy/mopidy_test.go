@@ -1,47 +1,203 @@
 package mopidy
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/michaelkleinhenz/piena/mopidy/mopidytest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMopidy(t *testing.T) {
+	server := mopidytest.NewServer(t)
+	server.Start()
+	defer server.Stop()
+	server.Set("core.playback.stop", nil)
 
-	client, err := NewClient("http://streamdeck:6680/mopidy/rpc")
+	client, err := NewClient(server.URL())
 	assert.NoError(t, err)
 
-	/*
-	err = client.RefreshLibrary()
+	err = client.Stop()
 	assert.NoError(t, err)
+	assert.Len(t, server.Called("core.playback.stop"), 1)
+
+	// errors of the player are not retried.
+	err = client.Play()
+	assert.EqualError(t, err, "-32601:Method not found")
+	assert.Len(t, server.Called("core.playback.play"), 1)
+}
+
+func TestTransport(t *testing.T) {
+	server := mopidytest.NewServer(t)
+	server.Start()
+	defer server.Stop()
+	client, err := NewClient(server.URL())
+	require.NoError(t, err)
+
+	tests := []struct {
+		method string
+		result interface{}
+		params string
+		call   func() error
+	}{
+		{"core.playback.pause", nil, "", client.Pause},
+		{"core.playback.resume", nil, "", client.Resume},
+		{"core.playback.next", nil, "", client.Next},
+		{"core.playback.previous", nil, "", client.Previous},
+		{"core.tracklist.shuffle", nil, "", client.Shuffle},
+		{"core.playback.seek", true, `{"time_position":90500}`, func() error { return client.Seek(90500 * time.Millisecond) }},
+		{"core.mixer.set_volume", true, `{"volume":40}`, func() error { return client.SetVolume(40) }},
+		{"core.mixer.set_mute", true, `{"mute":true}`, func() error { return client.SetMute(true) }},
+		{"core.tracklist.set_repeat", nil, `{"value":true}`, func() error { return client.SetRepeat(true) }},
+		{"core.tracklist.set_consume", nil, `{"value":false}`, func() error { return client.SetConsume(false) }},
+		{"core.tracklist.set_single", nil, `{"value":true}`, func() error { return client.SetSingle(true) }},
+	}
+	for _, test := range tests {
+		server.Set(test.method, test.result)
+		assert.NoError(t, test.call(), test.method)
+		params := server.Called(test.method)
+		if assert.Len(t, params, 1, test.method) && test.params != "" {
+			assert.JSONEq(t, test.params, string(params[0]), test.method)
+		}
+	}
+
+	// seeking fails without current track.
+	server.Set("core.playback.seek", false)
+	assert.Error(t, client.Seek(time.Second))
+}
 
-	available, numTracks, err := client.AudiobookAvailable("Jan Tenner", "01 - Ein neuer Anfang")
+func TestRetry(t *testing.T) {
+	server := mopidytest.NewServer(t)
+	server.Set("core.playback.stop", nil)
+	client, err := NewClient(server.URL())
+	require.NoError(t, err)
+	client.SetRetryOptions(RetryOptions{Attempts: 2, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond})
+
+	// the player is down.
+	err = client.Stop()
+	assert.Error(t, err)
+
+	// the player comes up while retrying.
+	client.SetRetryOptions(RetryOptions{Attempts: 10, InitialBackoff: 20 * time.Millisecond, MaxBackoff: 50 * time.Millisecond})
+	time.AfterFunc(50*time.Millisecond, server.Start)
+	err = client.Stop()
 	assert.NoError(t, err)
-	assert.True(t, available)
-	assert.Equal(t, 11, numTracks)
+	server.Stop()
+}
+
+func TestRetryOnlyUnsentCalls(t *testing.T) {
+	// the player drops the connection without answering, e.g. after a
+	// timeout.
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		connection, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		connection.Close()
+	}))
+	defer server.Close()
+	client, err := NewClient(server.URL)
+	require.NoError(t, err)
+	client.SetRetryOptions(RetryOptions{Attempts: 3, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond})
 
-	err = client.ClearTracklist()
+	// calls changing the player may have been handled and are not retried.
+	assert.Error(t, client.Next())
+	assert.Equal(t, 1, calls)
+	// getters are retried.
+	calls = 0
+	_, err = client.GetPlaybackState()
+	assert.Error(t, err)
+	assert.Equal(t, 3, calls)
+}
+
+func TestRetryContext(t *testing.T) {
+	server := mopidytest.NewServer(t)
+	client, err := NewClient(server.URL())
+	require.NoError(t, err)
+	client.SetRetryOptions(RetryOptions{Attempts: 3, InitialBackoff: time.Minute, MaxBackoff: time.Minute})
+	ctx, cancel := context.WithCancel(context.Background())
+	client.SetContext(ctx)
+
+	// the player is down, waiting to retry ends with the context.
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	assert.Error(t, client.Stop())
+	assert.WithinDuration(t, start, time.Now(), 10*time.Second)
+}
+
+func TestWaitUntilAvailable(t *testing.T) {
+	server := mopidytest.NewServer(t)
+	server.Set("core.playback.get_state", PlaybackStatePlaying)
+	client, err := NewClient(server.URL())
+	require.NoError(t, err)
+	client.SetRetryOptions(RetryOptions{Attempts: 1, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond})
+
+	// the player is down.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, client.WaitUntilAvailable(ctx))
+
+	// the player comes up.
+	time.AfterFunc(50*time.Millisecond, server.Start)
+	require.NoError(t, client.WaitUntilAvailable(context.Background()))
+	playbackState, err := client.GetPlaybackState()
+	require.NoError(t, err)
+	assert.Equal(t, PlaybackStatePlaying, playbackState)
+
+	// the player goes away and comes back.
+	server.Stop()
+	_, err = client.GetPlaybackState()
+	assert.Error(t, err)
+	time.AfterFunc(50*time.Millisecond, server.Start)
+	require.NoError(t, client.WaitUntilAvailable(context.Background()))
+	playbackState, err = client.GetPlaybackState()
+	require.NoError(t, err)
+	assert.Equal(t, PlaybackStatePlaying, playbackState)
+	server.Stop()
+}
+
+func TestTransportState(t *testing.T) {
+	server := mopidytest.NewServer(t)
+	server.Start()
+	defer server.Stop()
+	client, err := NewClient(server.URL())
+	require.NoError(t, err)
+	server.Set("core.playback.get_time_position", 61250)
+	server.Set("core.mixer.get_volume", 35)
+	server.Set("core.mixer.get_mute", true)
+	server.Set("core.tracklist.get_repeat", true)
+	server.Set("core.tracklist.get_consume", false)
+	server.Set("core.tracklist.get_single", true)
+
+	position, err := client.GetTimePosition()
 	assert.NoError(t, err)
+	assert.Equal(t, 61250*time.Millisecond, position)
 
-	err = client.AddToTracklist([]string{"local:track:01%20-%20Ein%20Neuer%20Anfang/01.mp3"})
+	volume, err := client.GetVolume()
 	assert.NoError(t, err)
+	assert.Equal(t, 35, volume)
 
-	err = client.Play()
+	mute, err := client.GetMute()
 	assert.NoError(t, err)
-	*/
+	assert.True(t, mute)
 
-	err = client.Stop()
+	repeat, err := client.GetRepeat()
 	assert.NoError(t, err)
+	assert.True(t, repeat)
 
-	/*
-		tracks, err := client.GetCurrentTracklist()
-		assert.NoError(t, err)
-		fmt.Println(tracks)
+	consume, err := client.GetConsume()
+	assert.NoError(t, err)
+	assert.False(t, consume)
 
-		track, err := client.GetCurrentTrack()
-		assert.NoError(t, err)
-		fmt.Println(track)
+	single, err := client.GetSingle()
+	assert.NoError(t, err)
+	assert.True(t, single)
 
-		client.Stop()
-	*/
+	// getters fail for errors of the player.
+	_, err = client.GetPlaybackState()
+	assert.Error(t, err)
 }
@@ -0,0 +1,127 @@
+// Package mopidytest provides a fake Mopidy JSON-RPC server for tests.
+package mopidytest
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// Server is a fake Mopidy JSON-RPC server. It can be stopped and started
+// again on the same address.
+type Server struct {
+	t       testing.TB
+	mutex   sync.Mutex
+	address string
+	server  *httptest.Server
+	// results are the results of the methods, methods without result
+	// return an error.
+	results map[string]interface{}
+	calls   []Call
+}
+
+// Call is a call of a method.
+type Call struct {
+	Method string
+	Params json.RawMessage
+}
+
+// NewServer returns a new server, not started yet.
+func NewServer(t testing.TB) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error reserving address: %s", err.Error())
+	}
+	server := new(Server)
+	server.t = t
+	server.address = listener.Addr().String()
+	server.results = map[string]interface{}{"core.get_version": "3.0.0"}
+	listener.Close()
+	return server
+}
+
+// URL returns the RPC endpoint of the server.
+func (s *Server) URL() string {
+	return "http://" + s.address + "/mopidy/rpc"
+}
+
+// Start starts serving, again after Stop.
+func (s *Server) Start() {
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		s.t.Fatalf("error listening on %s: %s", s.address, err.Error())
+	}
+	s.server = httptest.NewUnstartedServer(http.HandlerFunc(s.serve))
+	s.server.Listener.Close()
+	s.server.Listener = listener
+	s.server.Start()
+}
+
+// Stop makes the server go away.
+func (s *Server) Stop() {
+	s.server.Close()
+}
+
+// Set sets the result of the method.
+func (s *Server) Set(method string, result interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.results[method] = result
+}
+
+// Called returns the parameters of the calls of the method.
+func (s *Server) Called(method string) []json.RawMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	params := []json.RawMessage{}
+	for _, call := range s.calls {
+		if call.Method == method {
+			params = append(params, call.Params)
+		}
+	}
+	return params
+}
+
+// Calls returns the called methods.
+func (s *Server) Calls() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	methods := []string{}
+	for _, call := range s.calls {
+		methods = append(methods, call.Method)
+	}
+	return methods
+}
+
+// Reset forgets the calls.
+func (s *Server) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls = nil
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ID     int             `json:"id"`
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.mutex.Lock()
+	s.calls = append(s.calls, Call{Method: request.Method, Params: request.Params})
+	result, ok := s.results[request.Method]
+	s.mutex.Unlock()
+	response := map[string]interface{}{"jsonrpc": "2.0", "id": request.ID}
+	if ok {
+		response["result"] = result
+	} else {
+		response["error"] = map[string]interface{}{"code": -32601, "message": "Method not found"}
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,191 @@
+// Package ndef reads NDEF messages from NFC Forum Type 2 tags like NTAG21x
+// and MIFARE Ultralight.
+package ndef
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// TNFWellKnown is the type name format of NFC Forum well-known types.
+	TNFWellKnown = 0x01
+
+	flagMessageBegin = 0x80
+	flagMessageEnd   = 0x40
+	flagChunk        = 0x20
+	flagShortRecord  = 0x10
+	flagIDLength     = 0x08
+	maskTNF          = 0x07
+)
+
+// uriPrefixes are the abbreviations of URI records, see the NFC Forum URI
+// record type definition.
+var uriPrefixes = []string{
+	"", "http://www.", "https://www.", "http://", "https://", "tel:", "mailto:",
+	"ftp://anonymous:anonymous@", "ftp://ftp.", "ftps://", "sftp://", "smb://",
+	"nfs://", "ftp://", "dav://", "news:", "telnet://", "imap:", "rtsp://", "urn:",
+	"pop:", "sip:", "sips:", "tftp:", "btspp://", "btl2cap://", "btgoep://",
+	"tcpobex://", "irdaobex://", "file://", "urn:epc:id:", "urn:epc:tag:",
+	"urn:epc:pat:", "urn:epc:raw:", "urn:epc:", "urn:nfc:",
+}
+
+// Record is a single NDEF record.
+type Record struct {
+	TNF     byte
+	Type    []byte
+	ID      []byte
+	Payload []byte
+}
+
+// URI returns the URI of a well-known URI record.
+func (r Record) URI() (string, bool) {
+	if r.TNF != TNFWellKnown || string(r.Type) != "U" || len(r.Payload) == 0 {
+		return "", false
+	}
+	prefix := ""
+	if int(r.Payload[0]) < len(uriPrefixes) {
+		prefix = uriPrefixes[r.Payload[0]]
+	}
+	return prefix + string(r.Payload[1:]), true
+}
+
+// Text returns the text of a well-known text record. Only UTF-8 encoded
+// texts are supported.
+func (r Record) Text() (string, bool) {
+	if r.TNF != TNFWellKnown || string(r.Type) != "T" || len(r.Payload) == 0 {
+		return "", false
+	}
+	status := r.Payload[0]
+	if status&0x80 != 0 {
+		// UTF-16 encoded.
+		return "", false
+	}
+	languageLength := int(status & 0x3f)
+	if 1+languageLength > len(r.Payload) {
+		return "", false
+	}
+	return string(r.Payload[1+languageLength:]), true
+}
+
+// NewURIRecord returns a well-known URI record. The URI is stored without
+// abbreviation.
+func NewURIRecord(uri string) Record {
+	return Record{TNF: TNFWellKnown, Type: []byte("U"), Payload: append([]byte{0x00}, uri...)}
+}
+
+// NewTextRecord returns a well-known UTF-8 text record.
+func NewTextRecord(language string, text string) Record {
+	payload := append([]byte{byte(len(language))}, language...)
+	return Record{TNF: TNFWellKnown, Type: []byte("T"), Payload: append(payload, text...)}
+}
+
+// EncodeMessage encodes the records as NDEF message.
+func EncodeMessage(records []Record) []byte {
+	message := []byte{}
+	for idx, record := range records {
+		header := record.TNF & maskTNF
+		if idx == 0 {
+			header |= flagMessageBegin
+		}
+		if idx == len(records)-1 {
+			header |= flagMessageEnd
+		}
+		if len(record.Payload) < 256 {
+			header |= flagShortRecord
+		}
+		if len(record.ID) > 0 {
+			header |= flagIDLength
+		}
+		message = append(message, header, byte(len(record.Type)))
+		if header&flagShortRecord != 0 {
+			message = append(message, byte(len(record.Payload)))
+		} else {
+			length := make([]byte, 4)
+			binary.BigEndian.PutUint32(length, uint32(len(record.Payload)))
+			message = append(message, length...)
+		}
+		if len(record.ID) > 0 {
+			message = append(message, byte(len(record.ID)))
+		}
+		message = append(message, record.Type...)
+		message = append(message, record.ID...)
+		message = append(message, record.Payload...)
+	}
+	return message
+}
+
+// ParseMessage decodes the records of an NDEF message. Chunked records are
+// not supported.
+func ParseMessage(message []byte) ([]Record, error) {
+	records := []Record{}
+	for offset := 0; offset < len(message); {
+		header := message[offset]
+		if header&flagChunk != 0 {
+			return nil, errors.New("chunked ndef records are not supported")
+		}
+		offset++
+		if offset >= len(message) {
+			return nil, errors.New("truncated ndef record header")
+		}
+		typeLength := int(message[offset])
+		offset++
+		payloadLength := 0
+		if header&flagShortRecord != 0 {
+			if offset >= len(message) {
+				return nil, errors.New("truncated ndef record header")
+			}
+			payloadLength = int(message[offset])
+			offset++
+		} else {
+			if offset+4 > len(message) {
+				return nil, errors.New("truncated ndef record header")
+			}
+			payloadLength = int(binary.BigEndian.Uint32(message[offset:]))
+			offset += 4
+		}
+		idLength := 0
+		if header&flagIDLength != 0 {
+			if offset >= len(message) {
+				return nil, errors.New("truncated ndef record header")
+			}
+			idLength = int(message[offset])
+			offset++
+		}
+		end := offset + typeLength + idLength + payloadLength
+		if payloadLength < 0 || end > len(message) {
+			return nil, fmt.Errorf("truncated ndef record: need %d bytes, have %d", end, len(message))
+		}
+		record := Record{TNF: header & maskTNF}
+		record.Type = message[offset : offset+typeLength]
+		offset += typeLength
+		if idLength > 0 {
+			record.ID = message[offset : offset+idLength]
+		}
+		offset += idLength
+		record.Payload = message[offset:end]
+		offset = end
+		records = append(records, record)
+		if header&flagMessageEnd != 0 {
+			break
+		}
+	}
+	return records, nil
+}
+
+// FindURIOrText returns the first URI or text record starting with the
+// given prefix, without the prefix.
+func FindURIOrText(records []Record, prefix string) (string, bool) {
+	for _, record := range records {
+		value, ok := record.URI()
+		if !ok {
+			value, ok = record.Text()
+		}
+		if ok && strings.HasPrefix(value, prefix) {
+			return strings.TrimPrefix(value, prefix), true
+		}
+	}
+	return "", false
+}
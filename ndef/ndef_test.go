@@ -0,0 +1,101 @@
+package ndef
+
+import (
+	"testing"
+
+	"github.com/michaelkleinhenz/piena/ndef/ndeftest"
+	"github.com/stretchr/testify/assert"
+)
+
+func uriRecord(uri string) []byte {
+	payload := append([]byte{0x00}, uri...)
+	return append([]byte{0xd1, 0x01, byte(len(payload)), 'U'}, payload...)
+}
+
+func TestParseMessage(t *testing.T) {
+	t.Run("parsing uri record", func(t *testing.T) {
+		records, err := ParseMessage(uriRecord("piena://book/4711"))
+		assert.NoError(t, err)
+		assert.Len(t, records, 1)
+		uri, ok := records[0].URI()
+		assert.True(t, ok)
+		assert.Equal(t, "piena://book/4711", uri)
+	})
+	t.Run("expanding uri prefix", func(t *testing.T) {
+		records, err := ParseMessage([]byte{0xd1, 0x01, 0x0c, 'U', 0x04, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm'})
+		assert.NoError(t, err)
+		uri, _ := records[0].URI()
+		assert.Equal(t, "https://example.com", uri)
+	})
+	t.Run("parsing multiple records", func(t *testing.T) {
+		text := []byte{0x91, 0x01, 0x08, 'T', 0x02, 'e', 'n', 'h', 'e', 'l', 'l', 'o'}
+		uri := uriRecord("piena://book/4711")
+		uri[0] = 0x51
+		records, err := ParseMessage(append(text, uri...))
+		assert.NoError(t, err)
+		assert.Len(t, records, 2)
+		value, ok := records[0].Text()
+		assert.True(t, ok)
+		assert.Equal(t, "hello", value)
+		_, ok = records[0].URI()
+		assert.False(t, ok)
+		id, ok := FindURIOrText(records, "piena://book/")
+		assert.True(t, ok)
+		assert.Equal(t, "4711", id)
+	})
+	t.Run("rejecting truncated record", func(t *testing.T) {
+		_, err := ParseMessage(uriRecord("piena://book/4711")[:10])
+		assert.Error(t, err)
+	})
+}
+
+func TestReadType2Message(t *testing.T) {
+	t.Run("reading message", func(t *testing.T) {
+		record := uriRecord("piena://book/4711")
+		// lock control TLV before the message.
+		data := append([]byte{0x01, 0x03, 0xa0, 0x10, 0x44, 0x03, byte(len(record))}, record...)
+		tag := ndeftest.NewTag(append(data, 0xfe))
+		message, err := ReadType2Message(tag)
+		assert.NoError(t, err)
+		assert.Equal(t, record, message)
+		// only the pages containing the message are read.
+		assert.Equal(t, 3, tag.Reads)
+	})
+	t.Run("reading empty tag", func(t *testing.T) {
+		_, err := ReadType2Message(ndeftest.NewTag([]byte{0x03, 0x00, 0xfe}))
+		assert.Equal(t, ErrNoMessage, err)
+	})
+	t.Run("reading unformatted tag", func(t *testing.T) {
+		tag := ndeftest.NewTag(nil)
+		tag.Memory[capabilityPage*PageSize] = 0
+		_, err := ReadType2Message(tag)
+		assert.Equal(t, ErrNoMessage, err)
+	})
+}
+
+func TestWriteType2Message(t *testing.T) {
+	t.Run("writing message", func(t *testing.T) {
+		tag := ndeftest.NewTag(nil)
+		records := []Record{NewURIRecord("piena://book/4711"), NewTextRecord("en", "The Test Book")}
+		assert.NoError(t, WriteType2Message(tag, EncodeMessage(records)))
+		message, err := ReadType2Message(tag)
+		assert.NoError(t, err)
+		readRecords, err := ParseMessage(message)
+		assert.NoError(t, err)
+		assert.Equal(t, records, readRecords)
+	})
+	t.Run("rejecting too long message", func(t *testing.T) {
+		tag := ndeftest.NewTag(nil)
+		record := NewTextRecord("en", string(make([]byte, 200)))
+		assert.Error(t, WriteType2Message(tag, EncodeMessage([]Record{record})))
+	})
+	t.Run("locking tag", func(t *testing.T) {
+		tag := ndeftest.NewTag(nil)
+		tag.Memory = append(tag.Memory, make([]byte, 0x30*PageSize)...)
+		copy(tag.Memory[0x28*PageSize:], []byte{0x00, 0x00, 0x00, 0xbd})
+		assert.NoError(t, LockType2(tag))
+		assert.Equal(t, []byte{0xff, 0xff}, tag.Memory[staticLockPage*PageSize+2:staticLockPage*PageSize+4])
+		assert.Equal(t, []byte{0xff, 0xff, 0xff, 0xbd}, tag.Memory[0x28*PageSize:0x28*PageSize+4])
+		assert.Error(t, WriteType2Message(tag, EncodeMessage([]Record{NewURIRecord("piena://book/4712")})))
+	})
+}
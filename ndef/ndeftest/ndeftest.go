@@ -0,0 +1,50 @@
+// Package ndeftest provides a Type 2 tag kept in memory for tests.
+package ndeftest
+
+import "errors"
+
+const (
+	// pageSize is the size of a Type 2 tag page.
+	pageSize = 4
+	// readSize is the number of bytes returned by a READ command.
+	readSize = 16
+)
+
+// Tag is a Type 2 tag backed by a byte slice.
+type Tag struct {
+	// Memory is the content of the tag, starting with page 0.
+	Memory []byte
+	// Reads is the number of READ commands.
+	Reads int
+}
+
+// NewTag returns an NTAG213 formatted for NDEF, with data at the start of
+// the data area.
+func NewTag(data []byte) *Tag {
+	memory := make([]byte, 4*pageSize+144)
+	copy(memory[3*pageSize:], []byte{0xe1, 0x10, 0x12, 0x00})
+	copy(memory[4*pageSize:], data)
+	return &Tag{Memory: memory}
+}
+
+// ReadPages returns the 16 bytes starting at the given page.
+func (t *Tag) ReadPages(page byte) ([]byte, error) {
+	t.Reads++
+	start := int(page) * pageSize
+	if start >= len(t.Memory) {
+		return nil, errors.New("page out of range")
+	}
+	pages := make([]byte, readSize)
+	copy(pages, t.Memory[start:])
+	return pages, nil
+}
+
+// WritePage writes the four bytes of the given page.
+func (t *Tag) WritePage(page byte, data []byte) error {
+	start := int(page) * pageSize
+	if start+pageSize > len(t.Memory) || len(data) != pageSize {
+		return errors.New("page out of range")
+	}
+	copy(t.Memory[start:], data)
+	return nil
+}
@@ -0,0 +1,198 @@
+package ndef
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// ReadCommand reads four pages of a Type 2 tag.
+	ReadCommand = 0x30
+	// PageSize is the size of a Type 2 tag page.
+	PageSize = 4
+	// ReadSize is the number of bytes returned by a READ command.
+	ReadSize = 16
+	// WriteCommand writes a single page of a Type 2 tag.
+	WriteCommand = 0xa2
+
+	// staticLockPage is the page of the static lock bytes.
+	staticLockPage = 2
+	// capabilityPage is the page of the capability container.
+	capabilityPage = 3
+	// dataPage is the first page of the data area.
+	dataPage = 4
+	// ndefMagic marks a capability container of a tag with NDEF data.
+	ndefMagic = 0xe1
+
+	tlvNull       = 0x00
+	tlvNDEF       = 0x03
+	tlvTerminator = 0xfe
+)
+
+// dynamicLockPages are the pages of the dynamic lock bytes by data area
+// size of NTAG213, NTAG215 and NTAG216.
+var dynamicLockPages = map[byte]byte{
+	0x12: 0x28,
+	0x3e: 0x82,
+	0x6d: 0xe2,
+}
+
+// ErrNoMessage is returned if the tag contains no NDEF message.
+var ErrNoMessage = errors.New("tag contains no ndef message")
+
+// Type2Tag is a Type 2 tag, read with the READ command.
+type Type2Tag interface {
+	// ReadPages returns the 16 bytes starting at the given page.
+	ReadPages(page byte) ([]byte, error)
+}
+
+// Type2Writer is a writable Type 2 tag.
+type Type2Writer interface {
+	Type2Tag
+	// WritePage writes the four bytes of the given page.
+	WritePage(page byte, data []byte) error
+}
+
+// ReadType2Message reads the NDEF message from a Type 2 tag. ErrNoMessage is
+// returned if the tag is not formatted for NDEF or contains no message.
+func ReadType2Message(tag Type2Tag) ([]byte, error) {
+	capability, err := tag.ReadPages(capabilityPage)
+	if err != nil {
+		return nil, err
+	}
+	if len(capability) < PageSize {
+		return nil, errors.New("short read of capability container")
+	}
+	if capability[0] != ndefMagic {
+		return nil, ErrNoMessage
+	}
+	size := int(capability[2]) * 8
+	data := []byte{}
+	for page := dataPage; len(data) < size; page += ReadSize / PageSize {
+		pages, err := tag.ReadPages(byte(page))
+		if err != nil {
+			return nil, err
+		}
+		if len(pages) < ReadSize {
+			return nil, fmt.Errorf("short read of page %d", page)
+		}
+		data = append(data, pages...)
+		message, complete, err := findMessage(data)
+		if err != nil || complete {
+			return message, err
+		}
+	}
+	return nil, ErrNoMessage
+}
+
+// findMessage searches the TLV blocks of the data area for an NDEF message.
+// Returns false if more data is needed.
+func findMessage(data []byte) ([]byte, bool, error) {
+	for offset := 0; offset < len(data); {
+		tlvType := data[offset]
+		offset++
+		switch tlvType {
+		case tlvNull:
+			continue
+		case tlvTerminator:
+			return nil, true, ErrNoMessage
+		}
+		if offset >= len(data) {
+			return nil, false, nil
+		}
+		length := int(data[offset])
+		offset++
+		if length == 0xff {
+			if offset+2 > len(data) {
+				return nil, false, nil
+			}
+			length = int(data[offset])<<8 | int(data[offset+1])
+			offset += 2
+		}
+		if offset+length > len(data) {
+			return nil, false, nil
+		}
+		if tlvType == tlvNDEF {
+			if length == 0 {
+				return nil, true, ErrNoMessage
+			}
+			return data[offset : offset+length], true, nil
+		}
+		offset += length
+	}
+	return nil, false, nil
+}
+
+// WriteType2Message writes the NDEF message to a Type 2 tag formatted for
+// NDEF, replacing its data area.
+func WriteType2Message(tag Type2Writer, message []byte) error {
+	capability, err := tag.ReadPages(capabilityPage)
+	if err != nil {
+		return err
+	}
+	if len(capability) < PageSize {
+		return errors.New("short read of capability container")
+	}
+	if capability[0] != ndefMagic {
+		return errors.New("tag is not formatted for ndef")
+	}
+	if capability[3]&0x0f != 0 {
+		return errors.New("tag is read-only")
+	}
+	data := []byte{tlvNDEF}
+	if len(message) < 0xff {
+		data = append(data, byte(len(message)))
+	} else {
+		data = append(data, 0xff, byte(len(message)>>8), byte(len(message)))
+	}
+	data = append(data, message...)
+	data = append(data, tlvTerminator)
+	if size := int(capability[2]) * 8; len(data) > size {
+		return fmt.Errorf("message of %d bytes does not fit into %d bytes of the tag", len(data), size)
+	}
+	for len(data)%PageSize != 0 {
+		data = append(data, 0)
+	}
+	for offset := 0; offset < len(data); offset += PageSize {
+		page := byte(dataPage + offset/PageSize)
+		if err := tag.WritePage(page, data[offset:offset+PageSize]); err != nil {
+			return fmt.Errorf("writing page %d failed: %v", page, err)
+		}
+	}
+	return nil
+}
+
+// LockType2 makes a Type 2 tag permanently read-only by marking the
+// capability container read-only and setting the static and, for NTAG21x,
+// the dynamic lock bytes. This can not be undone.
+func LockType2(tag Type2Writer) error {
+	capability, err := tag.ReadPages(capabilityPage)
+	if err != nil {
+		return err
+	}
+	if len(capability) < PageSize || capability[0] != ndefMagic {
+		return errors.New("tag is not formatted for ndef")
+	}
+	// the capability container is one-time programmable, bits are only set.
+	err = tag.WritePage(capabilityPage, []byte{capability[0], capability[1], capability[2], 0x0f})
+	if err != nil {
+		return fmt.Errorf("writing capability container failed: %v", err)
+	}
+	if page, ok := dynamicLockPages[capability[2]]; ok {
+		lock, err := tag.ReadPages(page)
+		if err != nil {
+			return err
+		}
+		// the fourth byte is reserved and written as read.
+		err = tag.WritePage(page, []byte{0xff, 0xff, 0xff, lock[3]})
+		if err != nil {
+			return fmt.Errorf("writing dynamic lock bytes failed: %v", err)
+		}
+	}
+	// the first two bytes of the page are part of the UID and not written.
+	err = tag.WritePage(staticLockPage, []byte{0x00, 0x00, 0xff, 0xff})
+	if err != nil {
+		return fmt.Errorf("writing static lock bytes failed: %v", err)
+	}
+	return nil
+}
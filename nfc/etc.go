@@ -1,3 +1,6 @@
+//go:build libnfc
+// +build libnfc
+
 // Copyright (c) 2014, Robert Clausecker <fuzxxl@gmail.com>
 //
 // This program is free software: you can redistribute it and/or modify it
@@ -65,6 +68,9 @@ func Version() string {
 	return C.GoString(cstr)
 }
 
+// the global library context
+var theContext *context = &context{}
+
 // NFC context
 type context struct {
 	c *C.nfc_context
@@ -1,3 +1,6 @@
+//go:build libnfc
+// +build libnfc
+
 // Copyright (c) 2014, Robert Clausecker <fuzxxl@gmail.com>
 //
 // This program is free software: you can redistribute it and/or modify it
@@ -201,6 +201,3 @@ var errorMessages = map[int]string{
 	ESOFT:        "software error",
 	ECHIP:        "device's internal chip error",
 }
-
-// the global library context
-var theContext *context = &context{}
@@ -1,3 +1,6 @@
+//go:build libnfc
+// +build libnfc
+
 // Copyright (c) 2014, Robert Clausecker <fuzxxl@gmail.com>
 //
 // This program is free software: you can redistribute it and/or modify it
@@ -19,6 +22,7 @@ package nfc
 import "C"
 import "unsafe"
 import "errors"
+import "fmt"
 
 // allocate space using C.malloc() for a C.nfc_target.
 func mallocTarget() *C.nfc_target {
@@ -452,3 +456,34 @@ func (d *JewelTarget) Marshall() uintptr {
 
 	return uintptr(unsafe.Pointer(nt))
 }
+
+// Return a stable ID string for a target, made from the bytes identifying
+// the target: the UID, PUPI, IDm, NFCID3 or serial number depending on its
+// type, formatted as uppercase hex. IDs of ISO14443A targets are the UID
+// truncated to its length, the IDs of all other types are prefixed with the
+// type to avoid collisions.
+func TargetID(t Target) (string, error) {
+	switch t := t.(type) {
+	case *ISO14443aTarget:
+		uidLen := t.UIDLen
+		if uidLen <= 0 || uidLen > len(t.UID) {
+			return "", fmt.Errorf("invalid uid length %d", t.UIDLen)
+		}
+		return fmt.Sprintf("%X", t.UID[:uidLen]), nil
+	case *ISO14443bTarget:
+		return fmt.Sprintf("ISO14443B-%X", t.Pupi), nil
+	case *ISO14443biTarget:
+		return fmt.Sprintf("ISO14443BI-%X", t.DIV), nil
+	case *ISO14443b2srTarget:
+		return fmt.Sprintf("ISO14443B2SR-%X", t.UID), nil
+	case *ISO14443b2ctTarget:
+		return fmt.Sprintf("ISO14443B2CT-%X", t.UID), nil
+	case *FelicaTarget:
+		return fmt.Sprintf("FELICA-%X", t.ID), nil
+	case *JewelTarget:
+		return fmt.Sprintf("JEWEL-%X", t.ID), nil
+	case *DEPTarget:
+		return fmt.Sprintf("DEP-%X", t.NFCID3), nil
+	}
+	return "", errors.New("cannot determine id of target")
+}
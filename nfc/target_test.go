@@ -0,0 +1,33 @@
+//go:build libnfc
+// +build libnfc
+
+package nfc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetID(t *testing.T) {
+	testCases := []struct {
+		target Target
+		id     string
+	}{
+		{&ISO14443aTarget{UIDLen: 4, UID: [10]byte{0x04, 0xa1, 0xb2, 0xc3}}, "04A1B2C3"},
+		{&ISO14443aTarget{UIDLen: 7, UID: [10]byte{0x04, 0x52, 0x2b, 0x8a, 0x5e, 0x60, 0x80}}, "04522B8A5E6080"},
+		{&ISO14443bTarget{Pupi: [4]byte{0x01, 0x02, 0x03, 0x04}}, "ISO14443B-01020304"},
+		{&FelicaTarget{ID: [8]byte{0x01, 0x2e, 0x4c, 0x00, 0x00, 0x00, 0x00, 0x01}}, "FELICA-012E4C0000000001"},
+		{&JewelTarget{ID: [4]byte{0xde, 0xad, 0xbe, 0xef}}, "JEWEL-DEADBEEF"},
+		{&ISO14443b2srTarget{UID: [8]byte{0xd0, 0x02, 0x1a, 0x00, 0x00, 0x00, 0x00, 0x01}}, "ISO14443B2SR-D0021A0000000001"},
+	}
+	for _, testCase := range testCases {
+		id, err := TargetID(testCase.target)
+		assert.NoError(t, err)
+		assert.Equal(t, testCase.id, id)
+	}
+	_, err := TargetID(nil)
+	assert.Error(t, err)
+	_, err = TargetID(&ISO14443aTarget{UIDLen: 0})
+	assert.Error(t, err)
+}
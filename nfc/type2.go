@@ -0,0 +1,48 @@
+//go:build libnfc
+// +build libnfc
+
+package nfc
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/michaelkleinhenz/piena/ndef"
+)
+
+// type2Ack is the 4 bit ACK of NFC Forum Type 2 tags like NTAG21x and
+// MIFARE Ultralight.
+const type2Ack = 0x0a
+
+// Read four pages (16 bytes) starting at the given page from the currently
+// selected Type 2 tag.
+func (d Device) ReadPages(page byte) ([]byte, error) {
+	rx := make([]byte, ndef.ReadSize)
+	n, err := d.InitiatorTransceiveBytes([]byte{ndef.ReadCommand, page}, rx, -1)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(rx) {
+		return nil, fmt.Errorf("short read of page %d: %d bytes", page, n)
+	}
+	return rx, nil
+}
+
+// Write the four bytes of the given page of the currently selected Type 2
+// tag. The tag acknowledges the write with a 4 bit ACK, which may not be
+// returned by all devices, so writes should be verified by reading back.
+func (d Device) WritePage(page byte, data []byte) error {
+	if len(data) != ndef.PageSize {
+		return errors.New("page data must be 4 bytes")
+	}
+	tx := append([]byte{ndef.WriteCommand, page}, data...)
+	rx := make([]byte, 16)
+	n, err := d.InitiatorTransceiveBytes(tx, rx, -1)
+	if err != nil {
+		return err
+	}
+	if n > 0 && rx[0]&0x0f != type2Ack {
+		return fmt.Errorf("write of page %d not acknowledged: %#x", page, rx[0])
+	}
+	return nil
+}
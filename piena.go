@@ -1,55 +1,129 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
-	"net/url"
-	"strings"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	b "github.com/michaelkleinhenz/piena/base"
+	c "github.com/michaelkleinhenz/piena/config"
 	d "github.com/michaelkleinhenz/piena/downloader"
 	m "github.com/michaelkleinhenz/piena/mopidy"
+	p "github.com/michaelkleinhenz/piena/playback"
 	r "github.com/michaelkleinhenz/piena/reader"
 	s "github.com/michaelkleinhenz/piena/state"
 	u "github.com/michaelkleinhenz/piena/uploader"
 )
 
 var (
-	nfcReader *r.NfcReader
+	configuration *c.Config
+	readers map[string]*r.NfcReader
 	channel chan *r.NfcReadResult
-	player *m.Client
-	state *s.State
-	downloader *d.Downloader
-	// TODO: this should be the complete audiobook
-	lastSeenID string = ""
 )
 
 func main() {
 	playerPtr := flag.String("playerurl", "http://localhost:6680/mopidy/rpc", "Mopidy RPC endpoint address")
 	libraryURLPtr := flag.String("libraryurl", "http://d3aj4nh2mw9ghj.cloudfront.net/directory.json", "Audiobook library URL")
 	libraryDirectoryPtr := flag.String("librarypath", "/home/pi/audiobooks", "Audiobook local library path")
+	cacheDirectoryPtr := flag.String("cachepath", "", "Download cache path, defaults to the user cache directory")
 	readtagPtr := flag.Bool("readtag", false, "Read tag, output ID and exit")
+	configPtr := flag.String("config", "", "JSON configuration file with readers, command tags and removal policy, overrides the source and removal flags")
+	presentDebouncePtr := flag.Duration("presentdebounce", r.DefaultOptions.Debounce.Present, "Time a new tag has to be read before it is used")
+	absentDebouncePtr := flag.Duration("absentdebounce", r.DefaultOptions.Debounce.Absent, "Time a tag has to be missing before it counts as removed")
+	removalPolicyPtr := flag.String("removal", c.RemovalStop, "What happens when the tag is removed: stop, pause (resumes when the tag is placed again within the grace period) or ignore")
+	shutdownTimeoutPtr := flag.Duration("shutdowntimeout", 10*time.Second, "Maximum time to save the position and close the readers on SIGINT and SIGTERM")
+	removalGracePtr := flag.Duration("removalgrace", c.DefaultRemovalGracePeriod, "Time a paused audiobook is resumed when its tag is placed again")
+	sourcePtr := flag.String("source", "libnfc", "Tag source: libnfc, pn532, hid, serial or stdin (one tag ID per line, empty line removes the tag)")
+	sourceDevicePtr := flag.String("sourcedevice", "", "Device of pn532 (e.g. /dev/ttyS0 or /dev/i2c-1), hid (e.g. /dev/input/event0) and serial (e.g. /dev/ttyUSB0) tag sources")
+	sourceBaudRatePtr := flag.Int("sourcebaudrate", 0, "Baud rate of serial and pn532 tag sources, 0 uses 9600 for serial and 115200 for pn532")
+	sourceRemovalPtr := flag.Duration("sourceremoval", 0, "Time after the last reading a tag counts as removed for hid and serial tag sources, the default 0 never reports a removal and keeps the tag until another tag is read")
 	uploadPtr := flag.Bool("upload", false, "Upload audiobook to backend service")
 	uploadFileDir := flag.String("dir", "", "Directory with files to be uploaded")
 	uploadArtist := flag.String("artist", "", "Artist for uploaded files")
 	uploadTitle := flag.String("title", "", "Title for uploaded files")
 	uploadID := flag.String("id", "", "ID for uploaded files")
 	uploadBucket := 	flag.String("s3bucked", "tiena-files", "S3 bucket for upload")
+	uploadEncoder := flag.String("encoder", "ffmpeg", "Encoder for non-MP3 files and transcoding uploaded files")
+	uploadCodec := flag.String("codec", "", "Target codec for uploaded files (mp3, aac, opus, vorbis, flac), empty keeps the source codec")
+	uploadBitrate := flag.String("bitrate", "", "Target bitrate for transcoded files, e.g. 96k")
+	uploadDescription := flag.String("description", "", "Description of the uploaded audiobook")
+	uploadSeries := flag.String("series", "", "Series of the uploaded audiobook")
+	uploadSeriesIndex := flag.Int("seriesindex", 0, "Position of the uploaded audiobook in its series")
+	uploadAgeRating := flag.Int("agerating", 0, "Minimum recommended age for the uploaded audiobook")
+	uploadLanguage := flag.String("language", "", "ISO 639-1 language code of the uploaded audiobook")
+	uploadManifest := flag.String("batch", "", "CSV or YAML manifest for uploading a batch of audiobooks")
+	uploadTree := flag.String("batchdir", "", "Artist/Title folder tree for uploading a batch of audiobooks")
+	uploadReport := flag.String("batchreport", "", "File the batch upload report is written to, defaults to stdout")
+	uploadSigningKey := flag.String("signingkey", "", "File with the base64 encoded Ed25519 key the directory is signed with")
+	publicKeyPtr := flag.String("publickey", "", "Base64 encoded Ed25519 public key the library directory signature is verified with")
+	genkeyPtr := flag.Bool("genkey", false, "Generate a key pair for signing the directory, output it and exit")
 	flag.Parse()
 	log.Println("[main] piena starting..")
 
+	// check if we should run a tag command.
+	if flag.Arg(0) == "tag" {
+		runTagCommand(flag.Args()[1:])
+		return
+	}
+
+	// check if we should generate a signing key.
+	if *genkeyPtr {
+		privateKey, publicKey, err := b.GenerateSigningKey()
+		if err != nil {
+			log.Fatalf("[main] error generating signing key: %s", err.Error())
+		}
+		fmt.Printf("signing key: %s\npublic key:  %s\n", privateKey, publicKey)
+		return
+	}
+
 	var err error
 	// check if we should upload an audiobook.
 	if *uploadPtr {
+		uploader, err := u.NewUploader()
+		if err != nil {
+			log.Fatalf("[main] error initializing uploader: %s", err.Error())
+		}
+		err = uploader.SetEncoderOptions(u.EncoderOptions{Path: *uploadEncoder, Codec: *uploadCodec, Bitrate: *uploadBitrate})
+		if err != nil {
+			log.Fatalf("[main] error configuring encoder: %s", err.Error())
+		}
+		if *uploadSigningKey != "" {
+			signingKey, err := b.LoadSigningKey(*uploadSigningKey)
+			if err != nil {
+				log.Fatalf("[main] error loading signing key: %s", err.Error())
+			}
+			uploader.SetSigningKey(signingKey)
+		} else {
+			log.Println("[main] no signing key given, the directory will not be signed")
+		}
+		if *uploadManifest != "" || *uploadTree != "" {
+			uploadBatch(uploader, *uploadManifest, *uploadTree, *uploadReport, *uploadBucket)
+			return
+		}
 		if *uploadArtist == "" || *uploadFileDir == "" || *uploadID == "" || *uploadTitle == "" {
 			log.Fatal("[main] Not all required parameters given for file upload")
 		}
-		uploader, err := u.NewUploader()
-		packageFiles, err := uploader.TagRenameFiles(*uploadFileDir, *uploadArtist, *uploadTitle)
+		tracks, err := uploader.TagRenameFiles(*uploadFileDir, *uploadArtist, *uploadTitle)
 		if err != nil {
 			log.Fatalf("[main] error tagging upload files: %s", err.Error())
 		}
-		packageFile, err := uploader.PackageFiles(packageFiles, *uploadArtist, *uploadTitle)
+		details := u.AudiobookDetails{
+			Description: *uploadDescription,
+			Series: *uploadSeries,
+			SeriesIndex: *uploadSeriesIndex,
+			AgeRating: *uploadAgeRating,
+			Language: *uploadLanguage,
+		}
+		details.CoverImage, err = uploader.UploadCoverFile(*uploadArtist, *uploadTitle, *uploadBucket)
+		if err != nil {
+			log.Fatalf("[main] error uploading cover file: %s", err.Error())
+		}
+		packageFile, err := uploader.PackageFiles(tracks, *uploadArtist, *uploadTitle)
 		if err != nil {
 			log.Fatalf("[main] error packaging upload files: %s", err.Error())
 		}
@@ -57,7 +131,7 @@ func main() {
 		if err != nil {
 			log.Fatalf("[main] error uploading package file: %s", err.Error())
 		}
-		err = uploader.UpdateDirectory(packageFile, *uploadID, *uploadArtist, *uploadTitle, *uploadBucket)
+		err = uploader.UpdateDirectory(packageFile, tracks, *uploadID, *uploadArtist, *uploadTitle, details, *uploadBucket)
 		if err != nil {
 			log.Fatalf("[main] error updating directory: %s", err.Error())
 		}
@@ -65,248 +139,247 @@ func main() {
 		return
 	}
 
+	// cancel readers, polling and downloads on SIGINT and SIGTERM.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("[main] received %s, shutting down..", sig)
+		cancel()
+	}()
+
 	// initialize nfc reader hardware.
-	nfcReader, channel, err = r.NewNfcReader()
-  for err != nil {
-		log.Printf("[main] error initializing nfc hardware: %s, retrying..", err.Error())
-		nfcReader, channel, err = r.NewNfcReader()
+	readerConfig := c.Reader{Source: *sourcePtr, Device: *sourceDevicePtr, BaudRate: *sourceBaudRatePtr, RemovalTimeout: c.Duration{Duration: *sourceRemovalPtr}}
+	debounce := r.DebounceOptions{Present: *presentDebouncePtr, Absent: *absentDebouncePtr}
+	flagConfig := &c.Config{RemovalPolicy: *removalPolicyPtr, RemovalGracePeriod: c.Duration{Duration: *removalGracePtr}}
+	configuration, err = loadConfig(*configPtr, flagConfig, readerConfig)
+	if err != nil {
+		log.Fatalf("[main] error loading configuration: %s", err.Error())
 	}
-	defer nfcReader.Close()
+	readers = map[string]*r.NfcReader{}
+	channels := []chan *r.NfcReadResult{}
+	for _, readerConfig := range configuration.Readers {
+		log.Printf("[main] opening %s reader %s with role %s", readerConfig.Source, readerConfig.Name, readerConfig.Role)
+		reader, readerChannel := newReader(ctx, readerConfig, debounce)
+		defer reader.Close()
+		readers[readerConfig.Name] = reader
+		channels = append(channels, readerChannel)
+	}
+	channel = r.Merge(channels...)
 
 	// check if we should just read the tag
 	if *readtagPtr {
 		log.Println("[main] place tag on reader to readout tag ID..")
-		readevent := <-channel
+		readevent, ok := <-channel
+		if !ok {
+			return
+		}
 		switch readevent.Result {
 		case r.NfcStateError:
 			log.Printf("[main] error reading from nfc hardware: %s", readevent.Err.Error())
 		case r.NfcStateTagPresent:
-			log.Printf("[main] tag detected: %s", strings.TrimRight(readevent.ID, "0"))
+			log.Printf("[main] tag detected: %s (%s)", b.FormatTagID(readevent.ID, false), b.FormatTagID(readevent.ID, true))
 		}
 		log.Println("[main] operation done")
 		return
 	}
 
-	// initialize mopidy connection.
-	player, err = m.NewClient(*playerPtr)
-	err = player.RefreshLibrary()
-	if err != nil {
-		log.Fatalf("[main] error initializing mopidy connector: %s", err.Error())
-	}
-	err = player.Stop()
-	if err != nil {
-		log.Fatalf("[main] error initializing mopidy connector: %s", err.Error())
-	}
-	err = player.ClearTracklist()
+	// initialize mopidy connection, piena starts even when the player is down.
+	player, err := m.NewClient(*playerPtr)
 	if err != nil {
 		log.Fatalf("[main] error initializing mopidy connector: %s", err.Error())
 	}
+	player.SetContext(ctx)
 
 	// initialize persistence
-	state, err = s.NewState("state.json")
+	state, err := s.NewState("state.json")
 	if err != nil {
 		log.Fatalf("[main] error initializing persistence state: %s", err.Error())
 	}
 
 	// initialize downloader
-	downloader, err = d.NewDownloader(*libraryDirectoryPtr, *libraryURLPtr)
+	downloader, err := d.NewDownloader(*libraryDirectoryPtr, *libraryURLPtr, *cacheDirectoryPtr)
 	if err != nil {
 		log.Fatalf("[main] error initializing downloader: %s", err.Error())
 	}
+	if *publicKeyPtr != "" {
+		publicKey, err := b.ParsePublicKey(*publicKeyPtr)
+		if err != nil {
+			log.Fatalf("[main] error initializing downloader: %s", err.Error())
+		}
+		downloader.SetPublicKey(publicKey)
+	} else {
+		log.Println("[main] no public key given, the library directory signature is not verified")
+	}
+
+	// start processing loop, tracking the progress of the playing audiobook.
+	controller := p.NewController(configuration, player, downloader, state)
+	controller.SetReaders(readers)
+	controller.Run(ctx, channel)
+	shutdown(*shutdownTimeoutPtr, controller)
+}
 
-	// start gofunc that polls current track and updates state
+// shutdown saves the position of the playing audiobook, stops playback and
+// closes the readers. Exits if this takes longer than the timeout.
+func shutdown(timeout time.Duration, controller *p.Controller) {
+	done := make(chan struct{})
 	go func() {
-		for {
-			currentTrack, err := player.GetCurrentTrack()
-			if err != nil {
-				log.Fatalf("[main] error getting current track in polling loop: %s", err.Error())
-			}
-			if currentTrack != nil {
-				log.Printf("[main] polling loop: current track is %s", currentTrack.URI)
-				id, ord, err := getIdAndOrdForCurrentTrack(currentTrack)
-				if err != nil {
-					log.Printf("[main] error or unknown track when getting current id and ord in polling loop: %s", err.Error())
-				} else {
-					log.Printf("[main] storing updated ord %d for audiobook %s in polling loop", ord, id)
-					lastSeenID = id
-					if state.Exists(id) {
-						err = state.SetOrd(id, ord)
-						if err != nil {
-							log.Printf("[main] error storing updated track state in polling loop: %s", err.Error())
-						}	
-					} else {
-						err = state.Set(id, currentTrack.Artists[0].Name, currentTrack.Album.Name, ord)
-						if err != nil {
-							log.Printf("[main] error storing initial track state in polling loop: %s", err.Error())
-						}	
-					}		
-				}
-			} else {
-				// we are likely at the end of the playlist, remove state for lastSeenID
-				if lastSeenID != "" {
-					log.Printf("[main] polling loop: removing state for audiobook %s", lastSeenID)
-					err = state.Remove(lastSeenID)
-					if err != nil {
-						log.Printf("[main] error removing state in polling loop: %s", err.Error())
-					}	
-					// we also remove the tracklist in this case
-				  err = player.ClearTracklist()
-					if err != nil {
-						log.Printf("[main] error clearing tracklist in polling loop: %s", err.Error())
-					}	
-					lastSeenID = ""	
-				}
-			}
-			time.Sleep(1*time.Second)	
+		defer close(done)
+		err := controller.Shutdown()
+		if err != nil {
+			log.Printf("[main] error saving position: %s", err.Error())
 		}
-	}()
-
-	// start processing loop.
-	for {
-		event := <-channel
-		switch event.Result {
-		case r.NfcStateError:
-			log.Printf("[main] error reading from nfc hardware: %s", event.Err.Error())
-		case r.NfcStateTagNotPresent:
-			log.Println("[main] tag removed")
-			err = tagRemoved()
-			if err != nil {
-				log.Printf("[main] error when removing tag: %s", err.Error())
-			}
-		case r.NfcStateTagPresent:
-			log.Printf("[main] new tag detected: %s", event.ID)
-			err = tagDetected(event.ID)
-			if err != nil {
-				log.Printf("[main] error when processing detected tag %s: %s", event.ID, err.Error())
-			}
+		for _, reader := range readers {
+			reader.Close()
+		}
+		for range channel {
 		}
+	}()
+	select {
+	case <-done:
+		log.Println("[main] shutdown completed")
+	case <-time.After(timeout):
+		log.Fatalf("[main] shutdown timed out after %s", timeout)
 	}
 }
 
-func getIdAndOrdForCurrentTrack(currentTrack *m.Track) (string, int, error) {
-	id, err := downloader.GetID(currentTrack.Artists[0].Name, currentTrack.Album.Name)
-	if err != nil {
-		return "", -1, err
+// runTagCommand runs the tag subcommands, currently only "write".
+func runTagCommand(args []string) {
+	if len(args) == 0 || args[0] != "write" {
+		log.Fatal("[main] usage: piena tag write -id ID [-track N] [-lock] [-device CONNECTION]")
 	}
-	audiobook, _, err := downloader.GetAudiobook(id)
+	writeFlags := flag.NewFlagSet("tag write", flag.ExitOnError)
+	idPtr := writeFlags.String("id", "", "Audiobook ID written to the tag")
+	trackPtr := writeFlags.Int("track", 0, "Start track written to the tag, 0 for none")
+	lockPtr := writeFlags.Bool("lock", false, "Make the tag permanently read-only after writing")
+	devicePtr := writeFlags.String("device", "", "libnfc connection string of the reader, empty for the first reader")
+	timeoutPtr := writeFlags.Duration("timeout", 30*time.Second, "Time to wait for a tag to be placed on the reader")
+	writeFlags.Parse(args[1:])
+	log.Println("[main] place tag on reader to write it..")
+	uid, err := r.WriteTag(*devicePtr, r.WriteOptions{ID: *idPtr, Track: *trackPtr, Lock: *lockPtr, Timeout: *timeoutPtr})
 	if err != nil {
-		return "", -1, err
+		log.Fatalf("[main] error writing tag %s: %s", uid, err.Error())
 	}
-	ord := 1
-	for idx, trackName := range(audiobook.Tracks) {
-		if trackName.Title == currentTrack.Name {
-			ord = idx+1
+	log.Printf("[main] wrote audiobook %s to tag %s", *idPtr, uid)
+}
+
+// loadConfig loads the configuration file. Without file, the configuration
+// given by the flags is used. Without readers in the configuration, the
+// reader given by the flags is used, or without libnfc device given, a
+// reader for every libnfc device found.
+func loadConfig(configFile string, flagConfig *c.Config, flagReader c.Reader) (*c.Config, error) {
+	config := flagConfig
+	if configFile != "" {
+		var err error
+		config, err = c.Load(configFile)
+		if err != nil {
+			return nil, err
 		}
 	}
-	return id, ord, nil
+	if len(config.Readers) == 0 {
+		config.Readers = configureReaders(flagReader)
+	}
+	return config, config.Validate()
 }
 
-func tagRemoved() error {
-	currentTrack, err := player.GetCurrentTrack()
-	if err != nil {
-		log.Printf("[main] error getting current track: %s", err.Error())
+// configureReaders returns the reader given by the flags, or a reader for
+// every libnfc device found.
+func configureReaders(flagReader c.Reader) []c.Reader {
+	if flagReader.Source != "libnfc" || flagReader.Device != "" || !r.LibnfcSupported {
+		return []c.Reader{flagReader}
 	}
-	// stop current playback and clear tracklist
-	log.Println("[main] stopping and clearing current playlist")
-	// TODO: error handling
-	player.Stop()
-	player.ClearTracklist()
-	if currentTrack == nil {
-		// no current track, just return
-		return nil
-	} 
-	// get ord from track name (ord is not returned from player)	
-	id, ord, err := getIdAndOrdForCurrentTrack(currentTrack)
-	if err != nil {
-		log.Printf("[main] error getting audiobook for id: %s", err.Error())
+	devices, err := r.ListLibnfcDevices()
+	if err != nil || len(devices) == 0 {
+		log.Println("[main] no libnfc devices found, waiting for the first device")
+		return []c.Reader{flagReader}
 	}
-	log.Printf("[main] current track of audiobook is %d", ord)
-	if state.Exists(id) {
-		err = state.SetOrd(id, ord)
-		if err != nil {
-			log.Printf("[main] error storing updated track state: %s", err.Error())
-		}	
-	} else {
-		err = state.Set(id, currentTrack.Artists[0].Name, currentTrack.Album.Name, ord)
-		if err != nil {
-			log.Printf("[main] error storing initial track state: %s", err.Error())
-		}	
+	configuredReaders := []c.Reader{}
+	for _, device := range devices {
+		configuredReaders = append(configuredReaders, c.Reader{Source: "libnfc", Device: device})
 	}
-	// reset current id
-	lastSeenID = ""
-	return player.Stop()
+	return configuredReaders
 }
 
-func tagDetected(ID string) error {
-	log.Printf("[main] processing detected tag: %s", ID)
-	// retrieve book from ID
-	// TODO: display retrieval progress on UX
-	audiobook, alreadyExisted, err := downloader.GetAudiobook(ID)
-	if err != nil {
-		log.Printf("[main] error retrieving audiobook: %s", err.Error())
-		return err
-	}	
-	// store current id
-	lastSeenID = audiobook.ID
-	// if new, store initial dataset in store, else retrieve position
-	log.Printf("[main] found matching audiobook for id %s: %s %s", ID, audiobook.Artist, audiobook.Title)
-	ord := 1
-	if !state.Exists(ID) {
-		log.Printf("[main] no state exists for audiobook %s", ID)
-		state.Set(ID, audiobook.Artist, audiobook.Title, 1)
+// newReader returns a reader for the configured source. Hardware sources are
+// reopened by the reader when they fail. The debounce windows are used unless
+// configured for the reader.
+func newReader(ctx context.Context, readerConfig c.Reader, debounce r.DebounceOptions) (*r.NfcReader, chan *r.NfcReadResult) {
+	options := r.Options{Recovery: r.DefaultRecoveryOptions, Debounce: debounce}
+	if readerConfig.PresentDebounce != nil {
+		options.Debounce.Present = readerConfig.PresentDebounce.Duration
+	}
+	if readerConfig.AbsentDebounce != nil {
+		options.Debounce.Absent = readerConfig.AbsentDebounce.Duration
+	}
+	var open r.SourceOpener
+	switch readerConfig.Source {
+	case "libnfc":
+		if !r.LibnfcSupported {
+			log.Fatalf("[main] piena is built without libnfc support, rebuild with -tags libnfc or use another tag source")
+		}
+		open = func() (r.TagSource, error) {
+			return r.NewLibnfcSource(readerConfig.Device)
+		}
+	case "pn532":
+		open = func() (r.TagSource, error) {
+			return r.NewPN532Source(readerConfig.Device, readerConfig.BaudRate)
+		}
+	case "hid":
+		open = func() (r.TagSource, error) {
+			return r.NewHIDSource(readerConfig.Device, readerConfig.RemovalTimeout.Duration)
+		}
+	case "serial":
+		if readerConfig.BaudRate == 0 {
+			readerConfig.BaudRate = 9600
+		}
+		open = func() (r.TagSource, error) {
+			return r.NewSerialSource(readerConfig.Device, readerConfig.BaudRate, readerConfig.RemovalTimeout.Duration)
+		}
+	case "stdin":
+		log.Println("[main] reading tag IDs from stdin, one per line, empty line removes the tag")
+		open = func() (r.TagSource, error) {
+			return r.NewLineSource(os.Stdin), nil
+		}
+		options = r.Options{}
+	default:
+		log.Fatalf("[main] unknown tag source: %s", readerConfig.Source)
+	}
+	return r.NewRecoveringReader(ctx, readerConfig.Name, open, options)
+}
+
+func uploadBatch(uploader *u.Uploader, manifest string, tree string, reportFile string, bucket string) {
+	var entries []u.BatchEntry
+	var err error
+	if manifest != "" {
+		entries, err = u.ReadManifest(manifest)
 	} else {
-		ord, err = state.Get(ID)
-		if err != nil {
-			log.Printf("[main] error retrieving audiobook state: %s", err.Error())
-			// fallback: start over from track 1
-			state.Set(ID, audiobook.Artist, audiobook.Title, ord)
-		}		
-		log.Printf("[main] state exists for audiobook %s: current track is %d", ID, ord)
+		entries, err = u.ScanFolderTree(tree)
 	}
-	// stop current playback and clear tracklist
-	log.Println("[main] stopping and clearing current playlist")
-	err = player.Stop()
 	if err != nil {
-		log.Printf("[main] error stopping playback: %s", err.Error())
-		return err
-	}	
-	err = player.ClearTracklist()
-	if err != nil {
-		log.Printf("[main] error clearing tracklist: %s", err.Error())
-		return err
-	}	
-	// refresh library if needed
-	if alreadyExisted {
-		log.Println("[main] audiobook already existed in library, no refreshing necessary")
-	} else {
-		log.Println("[main] refreshing library")
-		err = player.RefreshLibrary()
-		if err != nil {
-			log.Printf("[main] error refreshing track library: %s", err.Error())
-			return err
-		}		
+		log.Fatalf("[main] error reading batch entries: %s", err.Error())
+	}
+	report, updateErr := uploader.UploadBatch(entries, bucket)
+	if updateErr != nil {
+		log.Printf("[main] error updating directory: %s", updateErr.Error())
 	}
-	// add new tracks to tracklist from the retrieved ord
-	log.Printf("[main] building new tracklist for audiobook %s from ord %d", ID, ord)
-	tracklist := []string{}
-	for idx, track := range(audiobook.Tracks) {
-		if idx >= ord-1 {
-			u := &url.URL{Path: "local:track:" + audiobook.Artist + "/" + audiobook.Title + "/" + track.Filename}
-			tracklist = append(tracklist, strings.TrimPrefix(u.String(), "./"))
+	out := os.Stdout
+	if reportFile != "" {
+		out, err = os.Create(reportFile)
+		if err != nil {
+			log.Fatalf("[main] error creating batch report: %s", err.Error())
 		}
+		defer out.Close()
 	}
-	log.Printf("[main] adding tracklist for audiobook %s to playlist: %s", ID, tracklist)
-	err = player.AddToTracklist(tracklist)
+	err = report.Write(out)
 	if err != nil {
-		log.Printf("[main] error adding tracks to tracklist: %s", err.Error())
-		return err
+		log.Printf("[main] error writing batch report: %s", err.Error())
 	}
-	// start playback
-	log.Printf("[main] starting playback for audiobook %s", ID)
-	err = player.Play()
-	if err != nil {
-		log.Printf("[main] error starting playback: %s", err.Error())
-		return err
+	// exit non-zero so scripts notice failed uploads.
+	if report.Failed() > 0 || updateErr != nil {
+		out.Close()
+		log.Fatalf("[main] batch upload completed, %d of %d audiobooks failed", report.Failed(), len(report.Results))
 	}
-	return nil
-}
\ No newline at end of file
+	log.Printf("[main] batch upload completed, %d of %d audiobooks failed", report.Failed(), len(report.Results))
+}
@@ -0,0 +1,79 @@
+package playback
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/michaelkleinhenz/piena/config"
+)
+
+// runCommand runs the action of a command tag.
+func (c *Controller) runCommand(ctx context.Context, command *config.Command) error {
+	log.Printf("[playback] running command %s of tag %s", command.Action, command.ID)
+	switch command.Action {
+	case config.ActionPause:
+		switch c.state {
+		case StatePlaying:
+			err := c.player.Pause()
+			c.transition(StatePaused, err)
+			return err
+		case StatePaused:
+			stopTimer(&c.graceTimer)
+			err := c.player.Resume()
+			c.transition(StatePlaying, err)
+			return err
+		}
+		log.Println("[playback] no audiobook playing, nothing to pause")
+		return nil
+	case config.ActionNext:
+		return c.player.Next()
+	case config.ActionPrevious:
+		return c.player.Previous()
+	case config.ActionRestart:
+		if c.audiobook == nil {
+			log.Println("[playback] no audiobook loaded, nothing to restart")
+			return nil
+		}
+		if err := c.store.Remove(c.audiobook.ID); err != nil {
+			log.Printf("[playback] error removing state of audiobook %s: %s", c.audiobook.ID, err.Error())
+		}
+		c.load(ctx, c.tagID, 0)
+		return nil
+	case config.ActionVolumeUp:
+		return c.changeVolume(command.Step)
+	case config.ActionVolumeDown:
+		return c.changeVolume(-command.Step)
+	case config.ActionSleep:
+		c.startSleepTimer(command.Duration.Duration)
+		return nil
+	case config.ActionShuffle:
+		return c.player.Shuffle()
+	}
+	return nil
+}
+
+// changeVolume changes the volume by the step, keeping it between 0 and 100.
+func (c *Controller) changeVolume(step int) error {
+	volume, err := c.player.GetVolume()
+	if err != nil {
+		return err
+	}
+	volume += step
+	if volume < 0 {
+		volume = 0
+	}
+	if volume > 100 {
+		volume = 100
+	}
+	log.Printf("[playback] setting volume to %d", volume)
+	return c.player.SetVolume(volume)
+}
+
+// startSleepTimer pauses playback after the duration. A running sleep timer
+// is restarted.
+func (c *Controller) startSleepTimer(duration time.Duration) {
+	stopTimer(&c.sleepTimer)
+	log.Printf("[playback] pausing playback in %s", duration)
+	c.sleepTimer = time.NewTimer(duration)
+}
@@ -0,0 +1,498 @@
+package playback
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/michaelkleinhenz/piena/base"
+	"github.com/michaelkleinhenz/piena/config"
+	"github.com/michaelkleinhenz/piena/mopidy"
+	"github.com/michaelkleinhenz/piena/reader"
+)
+
+// State is the playback state of the controller.
+type State string
+
+const (
+	// StateIdle indicates no audiobook is loaded.
+	StateIdle State = "idle"
+	// StateLoading indicates an audiobook is retrieved and queued.
+	StateLoading State = "loading"
+	// StatePlaying indicates the audiobook is playing.
+	StatePlaying State = "playing"
+	// StatePaused indicates the audiobook is paused.
+	StatePaused State = "paused"
+	// StateFinished indicates the last track of the audiobook has ended.
+	StateFinished State = "finished"
+	// StateError indicates loading or controlling the audiobook failed.
+	StateError State = "error"
+)
+
+// DefaultPollInterval is the interval the progress is tracked with.
+const DefaultPollInterval = time.Second
+
+// Player plays the tracks of audiobooks, implemented by mopidy.Client.
+type Player interface {
+	Play() error
+	Stop() error
+	Pause() error
+	Resume() error
+	Next() error
+	Previous() error
+	Shuffle() error
+	GetVolume() (int, error)
+	SetVolume(volume int) error
+	RefreshLibrary() error
+	WaitUntilAvailable(ctx context.Context) error
+	ClearTracklist() error
+	AddToTracklist(tracks []string) error
+	GetCurrentTrack() (*mopidy.Track, error)
+}
+
+// Library retrieves audiobooks, implemented by downloader.Downloader.
+type Library interface {
+	GetAudiobook(ctx context.Context, ID string) (*base.Audiobook, bool, error)
+}
+
+// Store stores the current track of audiobooks, implemented by state.State.
+type Store interface {
+	Exists(audiobookID string) bool
+	Get(audiobookID string) (int, error)
+	Set(audiobookID string, artist string, title string, ord int) error
+	SetOrd(audiobookID string, ord int) error
+	Remove(audiobookID string) error
+}
+
+// Controller plays the audiobooks of the tags placed on the readers. All
+// events are handled one after another by Run, so the state of the
+// controller is only changed by its goroutine.
+type Controller struct {
+	config  *config.Config
+	player  Player
+	library Library
+	store   Store
+	roles   map[string]string
+	readers map[string]*reader.NfcReader
+	// PollInterval is the interval the progress is tracked with.
+	PollInterval time.Duration
+
+	state     State
+	audiobook *base.Audiobook
+	// tagID is the ID of the tag the audiobook was started with.
+	tagID string
+	// reader is the name of the reader the audiobook was started with.
+	reader string
+	// playerAvailable is false until the player answered at start.
+	playerAvailable bool
+	// playerReady is false while the player is not available.
+	playerReady bool
+	graceTimer  *time.Timer
+	sleepTimer  *time.Timer
+}
+
+// NewController returns a new controller for the configuration.
+func NewController(configuration *config.Config, player Player, library Library, store Store) *Controller {
+	controller := new(Controller)
+	controller.config = configuration
+	controller.player = player
+	controller.library = library
+	controller.store = store
+	controller.roles = map[string]string{}
+	for _, readerConfig := range configuration.Readers {
+		controller.roles[readerConfig.Name] = readerConfig.Role
+	}
+	controller.PollInterval = DefaultPollInterval
+	controller.state = StateIdle
+	return controller
+}
+
+// SetReaders sets the readers, used to log their health on errors.
+func (c *Controller) SetReaders(readers map[string]*reader.NfcReader) {
+	c.readers = readers
+}
+
+// State returns the playback state.
+func (c *Controller) State() State {
+	return c.state
+}
+
+// Run handles the events of the readers and tracks the progress until the
+// context is done or the channel is closed. Events are handled while waiting
+// for the player at start, progress is tracked once it is available.
+func (c *Controller) Run(ctx context.Context, events <-chan *reader.NfcReadResult) {
+	available := make(chan error, 1)
+	go func() {
+		available <- c.player.WaitUntilAvailable(ctx)
+	}()
+	ticker := time.NewTicker(c.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			c.handleEvent(ctx, event)
+		case err := <-available:
+			available = nil
+			if err == nil {
+				c.resetPlayer()
+				go c.refreshLibrary()
+			}
+		case <-ticker.C:
+			c.poll()
+		case <-timerChannel(c.graceTimer):
+			c.graceExpired()
+		case <-timerChannel(c.sleepTimer):
+			c.sleepExpired()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Shutdown saves the position of the audiobook and stops playback. Must not
+// be called while Run is running.
+func (c *Controller) Shutdown() error {
+	stopTimer(&c.graceTimer)
+	stopTimer(&c.sleepTimer)
+	if c.state != StatePlaying && c.state != StatePaused {
+		return nil
+	}
+	log.Println("[playback] saving position and stopping playback")
+	err := c.stop()
+	c.transition(StateIdle, err)
+	return err
+}
+
+// handleEvent handles an event of a reader.
+func (c *Controller) handleEvent(ctx context.Context, event *reader.NfcReadResult) {
+	switch event.Result {
+	case reader.NfcStateError:
+		if nfcReader, ok := c.readers[event.Reader]; ok {
+			log.Printf("[playback] error reading from reader %s: %s (%s)", event.Reader, event.Err.Error(), nfcReader.Health())
+		} else {
+			log.Printf("[playback] error reading from reader %s: %s", event.Reader, event.Err.Error())
+		}
+	case reader.NfcStateTagNotPresent:
+		log.Printf("[playback] tag removed from reader %s", event.Reader)
+		c.tagRemoved(event.Reader)
+	case reader.NfcStateTagPresent:
+		log.Printf("[playback] new tag detected on reader %s: %s", event.Reader, event.ID)
+		c.tagPresent(ctx, event.Reader, event.ID, event.Track)
+	}
+}
+
+// tagPresent runs command tags and starts, resumes or keeps playing the
+// audiobook of other tags.
+func (c *Controller) tagPresent(ctx context.Context, readerName string, ID string, startTrack int) {
+	if command := c.config.Command(ID); command != nil {
+		err := c.runCommand(ctx, command)
+		if err != nil {
+			log.Printf("[playback] error running command %s: %s", command.Action, err.Error())
+		}
+		return
+	}
+	if c.roles[readerName] == config.RoleControl {
+		log.Printf("[playback] ignoring tag %s on control reader %s", ID, readerName)
+		return
+	}
+	sameTag := c.audiobook != nil && base.TagIDsMatch(c.tagID, ID)
+	switch {
+	case c.state == StatePaused && sameTag:
+		log.Printf("[playback] tag of paused audiobook %s placed again, resuming playback", ID)
+		stopTimer(&c.graceTimer)
+		c.reader = readerName
+		c.transition(StatePlaying, c.player.Resume())
+		return
+	case c.state == StatePlaying && sameTag:
+		log.Printf("[playback] audiobook %s is already playing", ID)
+		c.reader = readerName
+		return
+	}
+	stopTimer(&c.graceTimer)
+	c.reader = readerName
+	c.load(ctx, ID, startTrack)
+}
+
+// tagRemoved handles the removal of the tag of the audiobook according to
+// the removal policy. An audiobook paused by a command is handled like a
+// playing one, except that it is not paused again.
+func (c *Controller) tagRemoved(readerName string) {
+	if c.roles[readerName] == config.RoleControl || readerName != c.reader {
+		// the audiobook was not started on this reader.
+		return
+	}
+	if c.state != StatePlaying && c.state != StatePaused {
+		return
+	}
+	switch c.config.RemovalPolicy {
+	case config.RemovalIgnore:
+		log.Println("[playback] keeping playback running after tag removal")
+	case config.RemovalPause:
+		log.Printf("[playback] pausing playback, resuming when the tag is placed again within %s", c.config.RemovalGracePeriod.Duration)
+		stopTimer(&c.graceTimer)
+		c.graceTimer = time.NewTimer(c.config.RemovalGracePeriod.Duration)
+		if c.state == StatePlaying {
+			c.transition(StatePaused, c.player.Pause())
+		}
+	default:
+		c.transition(StateIdle, c.stop())
+	}
+}
+
+// graceExpired stops the audiobook paused by removing its tag.
+func (c *Controller) graceExpired() {
+	c.graceTimer = nil
+	if c.state != StatePaused {
+		return
+	}
+	log.Printf("[playback] tag of audiobook %s not placed again, stopping playback", c.audiobook.ID)
+	c.transition(StateIdle, c.stop())
+}
+
+// sleepExpired pauses the playing audiobook.
+func (c *Controller) sleepExpired() {
+	c.sleepTimer = nil
+	if c.state != StatePlaying {
+		return
+	}
+	log.Println("[playback] sleep timer expired, pausing playback")
+	c.transition(StatePaused, c.player.Pause())
+}
+
+// load retrieves the audiobook, queues its tracks from the stored or the
+// given track and starts playback.
+func (c *Controller) load(ctx context.Context, ID string, startTrack int) {
+	log.Printf("[playback] processing detected tag: %s", ID)
+	c.state = StateLoading
+	c.audiobook = nil
+	c.tagID = ID
+	audiobook, alreadyExisted, err := c.library.GetAudiobook(ctx, ID)
+	if err != nil {
+		log.Printf("[playback] error retrieving audiobook: %s", err.Error())
+		c.state = StateError
+		return
+	}
+	c.audiobook = audiobook
+	log.Printf("[playback] found matching audiobook for id %s: %s %s", ID, audiobook.Artist, audiobook.Title)
+	ord := 1
+	if !c.store.Exists(audiobook.ID) {
+		log.Printf("[playback] no state exists for audiobook %s", audiobook.ID)
+		if startTrack > 0 && startTrack <= len(audiobook.Tracks) {
+			log.Printf("[playback] starting audiobook %s with track %d given by tag", audiobook.ID, startTrack)
+			ord = startTrack
+		}
+		c.store.Set(audiobook.ID, audiobook.Artist, audiobook.Title, ord)
+	} else {
+		ord, err = c.store.Get(audiobook.ID)
+		if err != nil {
+			log.Printf("[playback] error retrieving audiobook state: %s", err.Error())
+			// fallback: start over from track 1
+			ord = 1
+			c.store.Set(audiobook.ID, audiobook.Artist, audiobook.Title, ord)
+		}
+		log.Printf("[playback] state exists for audiobook %s: current track is %d", audiobook.ID, ord)
+	}
+	c.transition(StatePlaying, c.queue(audiobook, ord, !alreadyExisted))
+}
+
+// queue replaces the tracklist with the tracks of the audiobook from the
+// ord and starts playback.
+func (c *Controller) queue(audiobook *base.Audiobook, ord int, refresh bool) error {
+	log.Println("[playback] stopping and clearing current playlist")
+	err := c.player.Stop()
+	if err != nil {
+		return err
+	}
+	err = c.player.ClearTracklist()
+	if err != nil {
+		return err
+	}
+	if refresh {
+		log.Println("[playback] refreshing library")
+		err = c.player.RefreshLibrary()
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("[playback] building new tracklist for audiobook %s from ord %d", audiobook.ID, ord)
+	tracklist := []string{}
+	for idx, track := range audiobook.Tracks {
+		if idx >= ord-1 {
+			u := &url.URL{Path: "local:track:" + audiobook.Artist + "/" + audiobook.Title + "/" + track.Filename}
+			tracklist = append(tracklist, strings.TrimPrefix(u.String(), "./"))
+		}
+	}
+	err = c.player.AddToTracklist(tracklist)
+	if err != nil {
+		return err
+	}
+	log.Printf("[playback] starting playback for audiobook %s", audiobook.ID)
+	return c.player.Play()
+}
+
+// stop saves the position of the audiobook, stops playback and clears the
+// tracklist.
+func (c *Controller) stop() error {
+	err := c.savePosition()
+	if err != nil {
+		log.Printf("[playback] error saving position: %s", err.Error())
+	}
+	log.Println("[playback] stopping and clearing current playlist")
+	c.reader = ""
+	err = c.player.Stop()
+	if err != nil {
+		return err
+	}
+	return c.player.ClearTracklist()
+}
+
+// savePosition stores the current track of the audiobook.
+func (c *Controller) savePosition() error {
+	track, err := c.player.GetCurrentTrack()
+	if err != nil {
+		return err
+	}
+	ord, ok := c.ord(track)
+	if !ok {
+		return nil
+	}
+	log.Printf("[playback] current track of audiobook %s is %d", c.audiobook.ID, ord)
+	return c.storeOrd(ord)
+}
+
+// poll tracks the progress of the audiobook. Removes the state of the
+// audiobook when its last track has ended.
+func (c *Controller) poll() {
+	if !c.playerAvailable {
+		return
+	}
+	track, err := c.player.GetCurrentTrack()
+	if err != nil {
+		if c.playerReady {
+			log.Printf("[playback] error getting current track, pausing progress tracking: %s", err.Error())
+			c.playerReady = false
+		}
+		return
+	}
+	if !c.playerReady {
+		log.Println("[playback] player is available again, resuming progress tracking")
+		c.playerReady = true
+		if track == nil && c.state == StatePlaying {
+			// a restarted player has an empty tracklist, keep the state.
+			c.transition(StateIdle, nil)
+			return
+		}
+	}
+	if c.state != StatePlaying {
+		return
+	}
+	if track == nil {
+		// the last track has ended, remove state and tracklist.
+		log.Printf("[playback] audiobook %s finished, removing state", c.audiobook.ID)
+		err = c.store.Remove(c.audiobook.ID)
+		if err != nil {
+			log.Printf("[playback] error removing state: %s", err.Error())
+		}
+		c.transition(StateFinished, c.player.ClearTracklist())
+		return
+	}
+	ord, ok := c.ord(track)
+	if !ok {
+		log.Printf("[playback] current track %s does not belong to audiobook %s", track.URI, c.audiobook.ID)
+		return
+	}
+	err = c.storeOrd(ord)
+	if err != nil {
+		log.Printf("[playback] error storing track state: %s", err.Error())
+	}
+}
+
+// resetPlayer stops playback and clears the tracklist of the player once it
+// is available at start, and starts tracking the progress. An audiobook
+// started by a tag placed while waiting for the player is kept.
+func (c *Controller) resetPlayer() {
+	c.playerAvailable = true
+	c.playerReady = true
+	if c.state != StateIdle {
+		log.Printf("[playback] player is available, keeping audiobook in state %s", c.state)
+		return
+	}
+	log.Println("[playback] player is available, stopping and clearing current playlist")
+	err := c.player.Stop()
+	if err == nil {
+		err = c.player.ClearTracklist()
+	}
+	if err != nil {
+		log.Printf("[playback] error resetting player: %s", err.Error())
+	}
+}
+
+// refreshLibrary refreshes the library of the player. Scanning the library
+// takes a while, so it runs beside Run.
+func (c *Controller) refreshLibrary() {
+	log.Println("[playback] refreshing library")
+	err := c.player.RefreshLibrary()
+	if err != nil {
+		log.Printf("[playback] error refreshing library: %s", err.Error())
+	}
+}
+
+// ord returns the ord of the track in the audiobook, false if the track does
+// not belong to the audiobook.
+func (c *Controller) ord(track *mopidy.Track) (int, bool) {
+	if track == nil || c.audiobook == nil || track.Album.Name != c.audiobook.Title {
+		return 0, false
+	}
+	if len(track.Artists) > 0 && track.Artists[0].Name != c.audiobook.Artist {
+		return 0, false
+	}
+	for idx, audiobookTrack := range c.audiobook.Tracks {
+		if audiobookTrack.Title == track.Name {
+			return idx + 1, true
+		}
+	}
+	return 1, true
+}
+
+// storeOrd stores the current track of the audiobook.
+func (c *Controller) storeOrd(ord int) error {
+	if c.store.Exists(c.audiobook.ID) {
+		return c.store.SetOrd(c.audiobook.ID, ord)
+	}
+	return c.store.Set(c.audiobook.ID, c.audiobook.Artist, c.audiobook.Title, ord)
+}
+
+// transition changes to the state, or to StateError if err is not nil.
+func (c *Controller) transition(state State, err error) {
+	if err != nil {
+		log.Printf("[playback] error changing from %s to %s: %s", c.state, state, err.Error())
+		state = StateError
+	} else if state != c.state {
+		log.Printf("[playback] changing from %s to %s", c.state, state)
+	}
+	c.state = state
+	if state == StateIdle || state == StateError {
+		stopTimer(&c.graceTimer)
+	}
+}
+
+// timerChannel returns the channel of the timer, nil if there is no timer.
+func timerChannel(timer *time.Timer) <-chan time.Time {
+	if timer == nil {
+		return nil
+	}
+	return timer.C
+}
+
+// stopTimer stops and removes the timer.
+func stopTimer(timer **time.Timer) {
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+}
@@ -0,0 +1,506 @@
+package playback
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/michaelkleinhenz/piena/base"
+	"github.com/michaelkleinhenz/piena/config"
+	"github.com/michaelkleinhenz/piena/mopidy"
+	"github.com/michaelkleinhenz/piena/reader"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errUnavailable = errors.New("player not available")
+
+// fakePlayer records the calls and plays the tracklist.
+type fakePlayer struct {
+	mutex     sync.Mutex
+	calls     []string
+	tracklist []string
+	track     *mopidy.Track
+	volume    int
+	// err is returned by all calls.
+	err error
+	// failPlay fails starting playback.
+	failPlay bool
+	// available blocks WaitUntilAvailable until it is closed, nil if the
+	// player is available.
+	available chan struct{}
+}
+
+func (p *fakePlayer) call(name string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.calls = append(p.calls, name)
+	return p.err
+}
+
+// called returns the calls, also while the controller is running.
+func (p *fakePlayer) called() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]string(nil), p.calls...)
+}
+
+func (p *fakePlayer) Play() error {
+	if p.failPlay {
+		return errors.New("play failed")
+	}
+	return p.call("play")
+}
+func (p *fakePlayer) Stop() error           { return p.call("stop") }
+func (p *fakePlayer) Pause() error          { return p.call("pause") }
+func (p *fakePlayer) Resume() error         { return p.call("resume") }
+func (p *fakePlayer) Next() error           { return p.call("next") }
+func (p *fakePlayer) Previous() error       { return p.call("previous") }
+func (p *fakePlayer) Shuffle() error        { return p.call("shuffle") }
+func (p *fakePlayer) RefreshLibrary() error { return p.call("refresh") }
+
+func (p *fakePlayer) WaitUntilAvailable(ctx context.Context) error {
+	if p.available == nil {
+		return nil
+	}
+	select {
+	case <-p.available:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *fakePlayer) GetVolume() (int, error) {
+	return p.volume, p.err
+}
+
+func (p *fakePlayer) SetVolume(volume int) error {
+	p.volume = volume
+	return p.call("volume")
+}
+
+func (p *fakePlayer) ClearTracklist() error {
+	if p.err == nil {
+		p.tracklist = nil
+		p.track = nil
+	}
+	return p.call("clear")
+}
+
+func (p *fakePlayer) AddToTracklist(tracks []string) error {
+	p.tracklist = append(p.tracklist, tracks...)
+	return p.call("add")
+}
+
+func (p *fakePlayer) GetCurrentTrack() (*mopidy.Track, error) {
+	return p.track, p.err
+}
+
+// play makes the track of the audiobook the current track.
+func (p *fakePlayer) play(audiobook *base.Audiobook, ord int) {
+	p.track = &mopidy.Track{
+		Album:   mopidy.Album{Name: audiobook.Title},
+		Artists: []mopidy.Artist{{Name: audiobook.Artist}},
+		Name:    audiobook.Tracks[ord-1].Title,
+	}
+}
+
+// fakeLibrary returns the audiobooks.
+type fakeLibrary struct {
+	audiobooks map[string]*base.Audiobook
+	controller *Controller
+	// loadingState is the state of the controller while loading.
+	loadingState State
+}
+
+func (l *fakeLibrary) GetAudiobook(ctx context.Context, ID string) (*base.Audiobook, bool, error) {
+	if l.controller != nil {
+		l.loadingState = l.controller.State()
+	}
+	audiobook, ok := l.audiobooks[ID]
+	if !ok {
+		return nil, false, errors.New("audiobook not found")
+	}
+	return audiobook, true, nil
+}
+
+// fakeStore stores the ords in memory.
+type fakeStore struct {
+	ords map[string]int
+}
+
+func (s *fakeStore) Exists(audiobookID string) bool {
+	_, ok := s.ords[audiobookID]
+	return ok
+}
+
+func (s *fakeStore) Get(audiobookID string) (int, error) {
+	ord, ok := s.ords[audiobookID]
+	if !ok {
+		return 0, errors.New("no state")
+	}
+	return ord, nil
+}
+
+func (s *fakeStore) Set(audiobookID string, artist string, title string, ord int) error {
+	s.ords[audiobookID] = ord
+	return nil
+}
+
+func (s *fakeStore) SetOrd(audiobookID string, ord int) error {
+	s.ords[audiobookID] = ord
+	return nil
+}
+
+func (s *fakeStore) Remove(audiobookID string) error {
+	delete(s.ords, audiobookID)
+	return nil
+}
+
+var (
+	firstAudiobook = &base.Audiobook{ID: "1", Artist: "Artist", Title: "First", Tracks: []base.AudiobookTrack{
+		{Title: "One", Filename: "01.mp3"},
+		{Title: "Two", Filename: "02.mp3"},
+		{Title: "Three", Filename: "03.mp3"},
+	}}
+	secondAudiobook = &base.Audiobook{ID: "2", Artist: "Artist", Title: "Second", Tracks: []base.AudiobookTrack{
+		{Title: "One", Filename: "01.mp3"},
+	}}
+)
+
+func newTestController(t *testing.T, removalPolicy string) (*Controller, *fakePlayer, *fakeStore) {
+	configuration := &config.Config{
+		Readers: []config.Reader{
+			{Name: "shelf", Source: "stdin"},
+			{Name: "buttons", Source: "stdin", Role: config.RoleControl},
+		},
+		Commands: []config.Command{
+			{ID: "pause", Action: config.ActionPause},
+			{ID: "restart", Action: config.ActionRestart},
+			{ID: "louder", Action: config.ActionVolumeUp},
+			{ID: "sleep", Action: config.ActionSleep, Duration: config.Duration{Duration: 10 * time.Millisecond}},
+		},
+		RemovalPolicy:      removalPolicy,
+		RemovalGracePeriod: config.Duration{Duration: 10 * time.Millisecond},
+	}
+	require.NoError(t, configuration.Validate())
+	player := new(fakePlayer)
+	library := &fakeLibrary{audiobooks: map[string]*base.Audiobook{"1": firstAudiobook, "2": secondAudiobook}}
+	store := &fakeStore{ords: map[string]int{}}
+	controller := NewController(configuration, player, library, store)
+	library.controller = controller
+	controller.resetPlayer()
+	return controller, player, store
+}
+
+func TestLoad(t *testing.T) {
+	controller, player, store := newTestController(t, config.RemovalStop)
+	library := controller.library.(*fakeLibrary)
+
+	// idle to loading to playing, from the track of the tag.
+	assert.Equal(t, StateIdle, controller.State())
+	controller.tagPresent(context.Background(), "shelf", "1", 2)
+	assert.Equal(t, StateLoading, library.loadingState)
+	assert.Equal(t, StatePlaying, controller.State())
+	assert.Equal(t, []string{"local:track:Artist/First/02.mp3", "local:track:Artist/First/03.mp3"}, player.tracklist)
+	assert.Equal(t, 2, store.ords["1"])
+
+	// the same tag keeps playing.
+	player.calls = nil
+	controller.tagPresent(context.Background(), "shelf", "1", 0)
+	assert.Equal(t, StatePlaying, controller.State())
+	assert.Empty(t, player.calls)
+
+	// another tag starts its audiobook.
+	controller.tagPresent(context.Background(), "shelf", "2", 0)
+	assert.Equal(t, StatePlaying, controller.State())
+	assert.Equal(t, []string{"local:track:Artist/Second/01.mp3"}, player.tracklist)
+
+	// the stored track is used.
+	store.ords["1"] = 3
+	controller.tagPresent(context.Background(), "shelf", "1", 1)
+	assert.Equal(t, []string{"local:track:Artist/First/03.mp3"}, player.tracklist)
+}
+
+func TestLoadError(t *testing.T) {
+	controller, player, _ := newTestController(t, config.RemovalStop)
+
+	// loading to error for an unknown audiobook.
+	controller.tagPresent(context.Background(), "shelf", "unknown", 0)
+	assert.Equal(t, StateError, controller.State())
+
+	// loading to error when the player fails.
+	player.failPlay = true
+	controller.tagPresent(context.Background(), "shelf", "1", 0)
+	assert.Equal(t, StateError, controller.State())
+
+	// error to playing with the next tag.
+	player.failPlay = false
+	controller.tagPresent(context.Background(), "shelf", "1", 0)
+	assert.Equal(t, StatePlaying, controller.State())
+}
+
+func TestRemovalStop(t *testing.T) {
+	controller, player, store := newTestController(t, config.RemovalStop)
+	controller.tagPresent(context.Background(), "shelf", "1", 0)
+	player.play(firstAudiobook, 2)
+
+	// removal on another reader is ignored.
+	controller.tagRemoved("buttons")
+	controller.tagRemoved("other")
+	assert.Equal(t, StatePlaying, controller.State())
+
+	// playing to idle, saving the position.
+	controller.tagRemoved("shelf")
+	assert.Equal(t, StateIdle, controller.State())
+	assert.Equal(t, 2, store.ords["1"])
+	assert.Empty(t, player.tracklist)
+}
+
+func TestRemovalPause(t *testing.T) {
+	controller, player, store := newTestController(t, config.RemovalPause)
+	controller.tagPresent(context.Background(), "shelf", "1", 0)
+	player.play(firstAudiobook, 2)
+
+	// playing to paused and back to playing within the grace period.
+	controller.tagRemoved("shelf")
+	assert.Equal(t, StatePaused, controller.State())
+	assert.NotNil(t, controller.graceTimer)
+	player.calls = nil
+	controller.tagPresent(context.Background(), "shelf", "1", 0)
+	assert.Equal(t, StatePlaying, controller.State())
+	assert.Equal(t, []string{"resume"}, player.calls)
+	assert.Nil(t, controller.graceTimer)
+
+	// paused to idle when the grace period expires.
+	controller.tagRemoved("shelf")
+	<-timerChannel(controller.graceTimer)
+	controller.graceExpired()
+	assert.Equal(t, StateIdle, controller.State())
+	assert.Equal(t, 2, store.ords["1"])
+
+	// paused to loading to playing for another tag.
+	controller.tagPresent(context.Background(), "shelf", "1", 0)
+	controller.tagRemoved("shelf")
+	controller.tagPresent(context.Background(), "shelf", "2", 0)
+	assert.Equal(t, StatePlaying, controller.State())
+	assert.Nil(t, controller.graceTimer)
+	assert.Equal(t, []string{"local:track:Artist/Second/01.mp3"}, player.tracklist)
+}
+
+func TestRemovalWhilePaused(t *testing.T) {
+	// paused to idle under the stop policy.
+	controller, player, store := newTestController(t, config.RemovalStop)
+	controller.tagPresent(context.Background(), "shelf", "1", 0)
+	player.play(firstAudiobook, 2)
+	controller.tagPresent(context.Background(), "buttons", "pause", 0)
+	assert.Equal(t, StatePaused, controller.State())
+	controller.tagRemoved("shelf")
+	assert.Equal(t, StateIdle, controller.State())
+	assert.Equal(t, 2, store.ords["1"])
+	assert.Empty(t, player.tracklist)
+
+	// paused stays paused under the pause policy and stops after the grace
+	// period.
+	controller, player, _ = newTestController(t, config.RemovalPause)
+	controller.tagPresent(context.Background(), "shelf", "1", 0)
+	controller.tagPresent(context.Background(), "buttons", "pause", 0)
+	player.calls = nil
+	controller.tagRemoved("shelf")
+	assert.Equal(t, StatePaused, controller.State())
+	assert.NotNil(t, controller.graceTimer)
+	assert.Empty(t, player.calls)
+	<-timerChannel(controller.graceTimer)
+	controller.graceExpired()
+	assert.Equal(t, StateIdle, controller.State())
+}
+
+func TestRemovalIgnore(t *testing.T) {
+	controller, player, _ := newTestController(t, config.RemovalIgnore)
+	controller.tagPresent(context.Background(), "shelf", "1", 0)
+
+	player.calls = nil
+	controller.tagRemoved("shelf")
+	assert.Equal(t, StatePlaying, controller.State())
+	controller.tagPresent(context.Background(), "shelf", "1", 0)
+	assert.Equal(t, StatePlaying, controller.State())
+	assert.Empty(t, player.calls)
+}
+
+func TestPoll(t *testing.T) {
+	controller, player, store := newTestController(t, config.RemovalStop)
+	controller.tagPresent(context.Background(), "shelf", "1", 0)
+
+	// the progress is stored.
+	player.play(firstAudiobook, 3)
+	controller.poll()
+	assert.Equal(t, 3, store.ords["1"])
+
+	// tracks of other audiobooks are not stored.
+	player.play(secondAudiobook, 1)
+	controller.poll()
+	assert.Equal(t, 3, store.ords["1"])
+	_, exists := store.ords["2"]
+	assert.False(t, exists)
+
+	// playing to finished at the end of the tracklist.
+	player.track = nil
+	controller.poll()
+	assert.Equal(t, StateFinished, controller.State())
+	_, exists = store.ords["1"]
+	assert.False(t, exists)
+
+	// finished to playing from the start.
+	controller.tagPresent(context.Background(), "shelf", "1", 0)
+	assert.Equal(t, StatePlaying, controller.State())
+	assert.Equal(t, 1, store.ords["1"])
+}
+
+func TestPollPlayerOutage(t *testing.T) {
+	controller, player, store := newTestController(t, config.RemovalStop)
+	controller.tagPresent(context.Background(), "shelf", "1", 0)
+	player.play(firstAudiobook, 2)
+	controller.poll()
+
+	// the player goes away.
+	player.err = errUnavailable
+	controller.poll()
+	assert.False(t, controller.playerReady)
+	assert.Equal(t, StatePlaying, controller.State())
+
+	// the player comes back with an empty tracklist, the state is kept.
+	player.err = nil
+	player.track = nil
+	controller.poll()
+	assert.True(t, controller.playerReady)
+	assert.Equal(t, StateIdle, controller.State())
+	assert.Equal(t, 2, store.ords["1"])
+}
+
+func TestPlayerReset(t *testing.T) {
+	controller, player, _ := newTestController(t, config.RemovalStop)
+	controller.playerAvailable = false
+	controller.PollInterval = time.Millisecond
+	player.calls = nil
+	player.available = make(chan struct{})
+	events := make(chan *reader.NfcReadResult)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		controller.Run(ctx, events)
+	}()
+
+	// events are handled while waiting for the player.
+	events <- &reader.NfcReadResult{Result: reader.NfcStateError, Err: errors.New("read failed"), Reader: "shelf"}
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, player.called())
+
+	// the player is reset when it becomes available, the library is
+	// refreshed beside.
+	close(player.available)
+	assert.Eventually(t, func() bool {
+		return len(player.called()) == 3
+	}, time.Second, time.Millisecond)
+	cancel()
+	<-done
+	assert.True(t, controller.playerAvailable)
+	assert.Equal(t, []string{"stop", "clear", "refresh"}, player.calls)
+}
+
+func TestPlayerAvailableAfterLoad(t *testing.T) {
+	controller, player, store := newTestController(t, config.RemovalStop)
+	controller.playerAvailable = false
+	controller.PollInterval = time.Millisecond
+	player.available = make(chan struct{})
+	events := make(chan *reader.NfcReadResult)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		controller.Run(ctx, events)
+	}()
+
+	// the player comes up while waiting and a tag is placed.
+	events <- &reader.NfcReadResult{Result: reader.NfcStateTagPresent, ID: "1", Reader: "shelf"}
+	events <- &reader.NfcReadResult{Result: reader.NfcStateError, Err: errors.New("read failed"), Reader: "shelf"}
+	player.play(firstAudiobook, 2)
+	player.calls = nil
+
+	// the audiobook keeps playing and its position is tracked.
+	close(player.available)
+	assert.Eventually(t, func() bool {
+		return len(player.called()) == 1
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	<-done
+	assert.Equal(t, []string{"refresh"}, player.calls)
+	assert.Equal(t, StatePlaying, controller.State())
+	assert.Equal(t, 2, store.ords["1"])
+	assert.Len(t, player.tracklist, 3)
+}
+
+func TestCommands(t *testing.T) {
+	controller, player, store := newTestController(t, config.RemovalStop)
+
+	// commands on the control reader, tags of audiobooks are ignored.
+	controller.tagPresent(context.Background(), "buttons", "1", 0)
+	assert.Equal(t, StateIdle, controller.State())
+	controller.tagPresent(context.Background(), "buttons", "pause", 0)
+	assert.Equal(t, StateIdle, controller.State())
+
+	// playing to paused and back with the pause command.
+	controller.tagPresent(context.Background(), "shelf", "1", 0)
+	controller.tagPresent(context.Background(), "buttons", "pause", 0)
+	assert.Equal(t, StatePaused, controller.State())
+	controller.tagPresent(context.Background(), "buttons", "pause", 0)
+	assert.Equal(t, StatePlaying, controller.State())
+
+	// volume is changed, up to 100.
+	player.volume = 95
+	controller.tagPresent(context.Background(), "buttons", "louder", 0)
+	assert.Equal(t, 100, player.volume)
+
+	// restart starts over.
+	player.play(firstAudiobook, 3)
+	controller.poll()
+	controller.tagPresent(context.Background(), "buttons", "restart", 0)
+	assert.Equal(t, StatePlaying, controller.State())
+	assert.Equal(t, 1, store.ords["1"])
+	assert.Len(t, player.tracklist, 3)
+
+	// playing to paused when the sleep timer expires.
+	controller.tagPresent(context.Background(), "buttons", "sleep", 0)
+	<-timerChannel(controller.sleepTimer)
+	controller.sleepExpired()
+	assert.Equal(t, StatePaused, controller.State())
+}
+
+func TestRun(t *testing.T) {
+	controller, player, store := newTestController(t, config.RemovalStop)
+	controller.PollInterval = time.Hour
+	events := make(chan *reader.NfcReadResult)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		controller.Run(ctx, events)
+	}()
+
+	events <- &reader.NfcReadResult{Result: reader.NfcStateTagPresent, ID: "1", Reader: "shelf"}
+	events <- &reader.NfcReadResult{Result: reader.NfcStateError, Err: errors.New("read failed"), Reader: "shelf"}
+	cancel()
+	<-done
+	assert.Equal(t, StatePlaying, controller.State())
+
+	// shutdown saves the position and stops playback.
+	player.play(firstAudiobook, 2)
+	assert.NoError(t, controller.Shutdown())
+	assert.Equal(t, StateIdle, controller.State())
+	assert.Equal(t, 2, store.ords["1"])
+	assert.Empty(t, player.tracklist)
+}
@@ -0,0 +1,127 @@
+package pn532
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// hostToPN532 is the frame identifier of frames sent by the host.
+	hostToPN532 = 0xd4
+	// pn532ToHost is the frame identifier of frames sent by the PN532.
+	pn532ToHost = 0xd5
+	// errorFrameCode is the data of an application level error frame.
+	errorFrameCode = 0x7f
+	// maxDataLength is the maximum length of the data of a normal frame,
+	// including the frame identifier.
+	maxDataLength = 0xff
+	// maxFrameLength is the length of a normal frame with maximum data.
+	maxFrameLength = maxDataLength + 7
+)
+
+var (
+	// startCode starts every frame, after an optional preamble.
+	startCode = []byte{0x00, 0xff}
+	// ackFrame acknowledges a command.
+	ackFrame = []byte{0x00, 0x00, 0xff, 0x00, 0xff, 0x00}
+	// nackFrame asks for a frame to be sent again.
+	nackFrame = []byte{0x00, 0x00, 0xff, 0xff, 0x00, 0x00}
+)
+
+var (
+	// ErrChecksum is returned for frames with invalid length or data
+	// checksum.
+	ErrChecksum = errors.New("pn532: invalid frame checksum")
+	// ErrApplication is returned if the PN532 answers with an error frame.
+	ErrApplication = errors.New("pn532: application level error")
+)
+
+// encodeFrame returns the normal information frame carrying the data, which
+// starts with the frame identifier.
+func encodeFrame(data []byte) ([]byte, error) {
+	if len(data) == 0 || len(data) > maxDataLength {
+		return nil, fmt.Errorf("pn532: invalid frame data length %d", len(data))
+	}
+	frame := []byte{0x00, 0x00, 0xff, byte(len(data)), byte(-len(data))}
+	frame = append(frame, data...)
+	frame = append(frame, checksum(data), 0x00)
+	return frame, nil
+}
+
+// decodeFrame parses a frame. For ACK frames, ack is true and data is nil.
+// Bytes following the frame are ignored.
+func decodeFrame(frame []byte) (data []byte, ack bool, err error) {
+	start := bytes.Index(frame, startCode)
+	if start < 0 || len(frame) < start+4 {
+		return nil, false, errors.New("pn532: incomplete frame")
+	}
+	length, lengthChecksum := frame[start+2], frame[start+3]
+	switch {
+	case length == 0x00 && lengthChecksum == 0xff:
+		return nil, true, nil
+	case length == 0xff && lengthChecksum == 0x00:
+		return nil, false, errors.New("pn532: unexpected nack frame")
+	case length+lengthChecksum != 0:
+		return nil, false, ErrChecksum
+	}
+	body := frame[start+4:]
+	if len(body) < int(length)+1 {
+		return nil, false, errors.New("pn532: incomplete frame")
+	}
+	data = body[:length]
+	if checksum(data) != body[length] {
+		return nil, false, ErrChecksum
+	}
+	if len(data) == 1 && data[0] == errorFrameCode {
+		return nil, false, ErrApplication
+	}
+	return data, false, nil
+}
+
+// readFrame reads the next frame from a byte stream, skipping bytes before
+// its start code.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	previous := byte(0xff)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if previous == startCode[0] && b == startCode[1] {
+			break
+		}
+		previous = b
+	}
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	frame := append([]byte{0x00, 0x00, 0xff}, header...)
+	length, lengthChecksum := header[0], header[1]
+	if (length == 0x00 && lengthChecksum == 0xff) || (length == 0xff && lengthChecksum == 0x00) {
+		// ack and nack frames only have the postamble left.
+		_, err := r.ReadByte()
+		return append(frame, 0x00), err
+	}
+	if length+lengthChecksum != 0 {
+		return nil, ErrChecksum
+	}
+	// data, data checksum and postamble.
+	body := make([]byte, int(length)+2)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return append(frame, body...), nil
+}
+
+// checksum returns the byte making the sum of the data zero.
+func checksum(data []byte) byte {
+	sum := byte(0)
+	for _, b := range data {
+		sum += b
+	}
+	return -sum
+}
@@ -0,0 +1,260 @@
+// Package pn532 is a driver for NXP PN532 NFC controllers connected to a
+// UART or an I2C bus. It implements the subset of the PN532 commands needed
+// to poll ISO14443A tags and exchange data with them, without cgo.
+package pn532
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/michaelkleinhenz/piena/ndef"
+)
+
+// Commands of the PN532.
+const (
+	CommandGetFirmwareVersion  = 0x02
+	CommandSAMConfiguration    = 0x14
+	CommandRFConfiguration     = 0x32
+	CommandInDataExchange      = 0x40
+	CommandInListPassiveTarget = 0x4a
+	CommandInRelease           = 0x52
+)
+
+const (
+	// BaudRate106A selects ISO14443A targets at 106 kbps in
+	// InListPassiveTarget.
+	BaudRate106A = 0x00
+
+	// samNormalMode disables the security access module.
+	samNormalMode = 0x01
+	// rfMaxRetries is the RFConfiguration item for the number of retries.
+	rfMaxRetries = 0x05
+	// passiveActivationRetries is the number of retries to activate a
+	// passive target, 0xff would retry forever.
+	passiveActivationRetries = 0x02
+
+	// defaultAckTimeout is the time to wait for the ACK of a command.
+	defaultAckTimeout = 100 * time.Millisecond
+	// defaultTimeout is the time to wait for the response to a command.
+	defaultTimeout = time.Second
+	// drainTimeout is the time to wait for pending frames to drop.
+	drainTimeout = 10 * time.Millisecond
+)
+
+// Firmware is the firmware version of a PN532.
+type Firmware struct {
+	IC       byte
+	Version  byte
+	Revision byte
+	Support  byte
+}
+
+func (f Firmware) String() string {
+	return fmt.Sprintf("PN5%02x v%d.%d", f.IC, f.Version, f.Revision)
+}
+
+// Target is a passive ISO14443A target found by InListPassiveTarget.
+type Target struct {
+	// Number is the logical number of the target used in InDataExchange.
+	Number byte
+	// SensRes is the ATQA of the target.
+	SensRes uint16
+	// SelRes is the SAK of the target.
+	SelRes byte
+	// UID is the NFCID1 of the target.
+	UID []byte
+	// ATS is the answer to select of ISO14443-4 targets, nil otherwise.
+	ATS []byte
+}
+
+// Device is a PN532 acting as initiator (reader).
+type Device struct {
+	transport Transport
+	// Timeout is the time to wait for the response to a command.
+	Timeout time.Duration
+	// target is the logical number of the selected target.
+	target byte
+	// stale is set after a command timed out, its response may still
+	// arrive and has to be dropped.
+	stale bool
+}
+
+// NewDevice returns a device using the given transport. The device owns
+// the transport and closes it.
+func NewDevice(transport Transport) *Device {
+	d := new(Device)
+	d.transport = transport
+	d.Timeout = defaultTimeout
+	return d
+}
+
+// Close closes the transport.
+func (d *Device) Close() error {
+	return d.transport.Close()
+}
+
+// Command sends the command with the parameters and returns the parameters
+// of the response.
+func (d *Device) Command(command byte, params []byte) ([]byte, error) {
+	if d.stale {
+		d.drain()
+	}
+	frame, err := encodeFrame(append([]byte{hostToPN532, command}, params...))
+	if err != nil {
+		return nil, err
+	}
+	if err := d.transport.Send(frame); err != nil {
+		return nil, err
+	}
+	if err := d.receiveAck(); err != nil {
+		return nil, err
+	}
+	response, err := d.transport.Receive(d.Timeout)
+	if err == ErrTimeout {
+		// an ack frame aborts the command.
+		d.stale = true
+		d.transport.Send(ackFrame)
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, _, err := decodeFrame(response)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 2 || data[0] != pn532ToHost || data[1] != command+1 {
+		return nil, fmt.Errorf("pn532: unexpected response to command %#02x: % x", command, data)
+	}
+	return data[2:], nil
+}
+
+func (d *Device) receiveAck() error {
+	frame, err := d.transport.Receive(defaultAckTimeout)
+	if err != nil {
+		return err
+	}
+	_, ack, err := decodeFrame(frame)
+	if err != nil {
+		return err
+	}
+	if !ack {
+		return errors.New("pn532: command not acknowledged")
+	}
+	return nil
+}
+
+// drain drops pending frames.
+func (d *Device) drain() {
+	for {
+		if _, err := d.transport.Receive(drainTimeout); err != nil {
+			break
+		}
+	}
+	d.stale = false
+}
+
+// FirmwareVersion returns the firmware version.
+func (d *Device) FirmwareVersion() (Firmware, error) {
+	response, err := d.Command(CommandGetFirmwareVersion, nil)
+	if err != nil {
+		return Firmware{}, err
+	}
+	if len(response) != 4 {
+		return Firmware{}, fmt.Errorf("pn532: invalid firmware version: % x", response)
+	}
+	return Firmware{IC: response[0], Version: response[1], Revision: response[2], Support: response[3]}, nil
+}
+
+// InitiatorInit configures the PN532 as initiator. The security access
+// module is disabled and the activation of passive targets is retried only
+// a few times, so InListPassiveTarget returns if no target is present.
+func (d *Device) InitiatorInit() error {
+	if _, err := d.Command(CommandSAMConfiguration, []byte{samNormalMode, 0x14, 0x01}); err != nil {
+		return err
+	}
+	_, err := d.Command(CommandRFConfiguration, []byte{rfMaxRetries, 0xff, 0x01, passiveActivationRetries})
+	return err
+}
+
+// InListPassiveTarget selects a passive ISO14443A target. Returns nil if no
+// target is present.
+func (d *Device) InListPassiveTarget() (*Target, error) {
+	response, err := d.Command(CommandInListPassiveTarget, []byte{0x01, BaudRate106A})
+	if err != nil {
+		return nil, err
+	}
+	if len(response) == 0 {
+		return nil, errors.New("pn532: empty target list")
+	}
+	if response[0] == 0 {
+		return nil, nil
+	}
+	// Tg, SENS_RES, SEL_RES, NFCIDLength, NFCID1, optional ATS.
+	data := response[1:]
+	if len(data) < 5 || len(data) < 5+int(data[4]) {
+		return nil, fmt.Errorf("pn532: invalid target data: % x", data)
+	}
+	target := new(Target)
+	target.Number = data[0]
+	target.SensRes = uint16(data[1])<<8 | uint16(data[2])
+	target.SelRes = data[3]
+	target.UID = append([]byte{}, data[5:5+int(data[4])]...)
+	if ats := data[5+int(data[4]):]; len(ats) > 0 {
+		target.ATS = append([]byte{}, ats...)
+	}
+	d.target = target.Number
+	return target, nil
+}
+
+// InDataExchange sends the data to the selected target and returns its
+// answer.
+func (d *Device) InDataExchange(data []byte) ([]byte, error) {
+	if d.target == 0 {
+		return nil, errors.New("pn532: no target selected")
+	}
+	response, err := d.Command(CommandInDataExchange, append([]byte{d.target}, data...))
+	if err != nil {
+		return nil, err
+	}
+	if len(response) == 0 {
+		return nil, errors.New("pn532: empty data exchange response")
+	}
+	if status := response[0] & 0x3f; status != 0 {
+		return nil, fmt.Errorf("pn532: data exchange failed with status %#02x", status)
+	}
+	return response[1:], nil
+}
+
+// InRelease releases the selected target.
+func (d *Device) InRelease() error {
+	if d.target == 0 {
+		return nil
+	}
+	_, err := d.Command(CommandInRelease, []byte{d.target})
+	d.target = 0
+	return err
+}
+
+// ReadPages reads four pages (16 bytes) starting at the given page from the
+// selected Type 2 tag.
+func (d *Device) ReadPages(page byte) ([]byte, error) {
+	data, err := d.InDataExchange([]byte{ndef.ReadCommand, page})
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != ndef.ReadSize {
+		return nil, fmt.Errorf("short read of page %d: %d bytes", page, len(data))
+	}
+	return data, nil
+}
+
+// WritePage writes the four bytes of the given page of the selected Type 2
+// tag.
+func (d *Device) WritePage(page byte, data []byte) error {
+	if len(data) != ndef.PageSize {
+		return errors.New("page data must be 4 bytes")
+	}
+	_, err := d.InDataExchange(append([]byte{ndef.WriteCommand, page}, data...))
+	return err
+}
@@ -0,0 +1,259 @@
+package pn532
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/michaelkleinhenz/piena/ndef"
+)
+
+// simulator answers commands like a PN532 with an NTAG213 in its field.
+type simulator struct {
+	mutex sync.Mutex
+	// present is true while the tag is in the field.
+	present bool
+	// silent commands are acknowledged, but not answered.
+	silent map[byte]bool
+	memory []byte
+	// commands are the received commands.
+	commands []byte
+}
+
+func newSimulator() *simulator {
+	s := new(simulator)
+	s.silent = map[byte]bool{}
+	s.memory = make([]byte, 4*ndef.PageSize+144)
+	copy(s.memory[3*ndef.PageSize:], []byte{0xe1, 0x10, 0x12, 0x00})
+	return s
+}
+
+// respond returns the frames sent in response to the frame.
+func (s *simulator) respond(frame []byte) [][]byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, ack, err := decodeFrame(frame)
+	if err != nil || ack {
+		return nil
+	}
+	command, params := data[1], data[2:]
+	s.commands = append(s.commands, command)
+	if s.silent[command] {
+		return [][]byte{ackFrame}
+	}
+	var response []byte
+	switch command {
+	case CommandGetFirmwareVersion:
+		response = []byte{0x32, 0x01, 0x06, 0x07}
+	case CommandSAMConfiguration, CommandRFConfiguration:
+	case CommandInListPassiveTarget:
+		if !s.present {
+			response = []byte{0x00}
+		} else {
+			response = []byte{0x01, 0x01, 0x00, 0x44, 0x00, 0x07, 0x04, 0xa1, 0xb2, 0xc3, 0xd4, 0xe5, 0xf6}
+		}
+	case CommandInDataExchange:
+		response = s.exchange(params[1:])
+	default:
+		return [][]byte{ackFrame, {0x00, 0x00, 0xff, 0x01, 0xff, errorFrameCode, 0x81, 0x00}}
+	}
+	encoded, _ := encodeFrame(append([]byte{pn532ToHost, command + 1}, response...))
+	return [][]byte{ackFrame, encoded}
+}
+
+// exchange answers Type 2 tag commands.
+func (s *simulator) exchange(data []byte) []byte {
+	if !s.present {
+		// timeout of the target.
+		return []byte{0x01}
+	}
+	start := int(data[1]) * ndef.PageSize
+	switch data[0] {
+	case ndef.ReadCommand:
+		pages := make([]byte, ndef.ReadSize)
+		copy(pages, s.memory[start:])
+		return append([]byte{0x00}, pages...)
+	case ndef.WriteCommand:
+		copy(s.memory[start:start+ndef.PageSize], data[2:])
+		return []byte{0x00}
+	}
+	return []byte{0x27}
+}
+
+// serve answers the frames read from the stream.
+func (s *simulator) serve(r io.Reader, w io.Writer) {
+	reader := bufio.NewReader(r)
+	for {
+		frame, err := readFrame(reader)
+		if err != nil {
+			return
+		}
+		for _, response := range s.respond(frame) {
+			w.Write(response)
+		}
+	}
+}
+
+// pipePort connects the host to the simulator.
+type pipePort struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (p pipePort) Close() error {
+	p.PipeReader.Close()
+	return p.PipeWriter.Close()
+}
+
+func newHSUDevice(s *simulator) *Device {
+	hostReader, simWriter := io.Pipe()
+	simReader, hostWriter := io.Pipe()
+	go s.serve(simReader, simWriter)
+	return NewDevice(NewHSUTransport(pipePort{hostReader, hostWriter}))
+}
+
+// i2cBus is an I2C bus with the simulator, not ready for the first reads.
+type i2cBus struct {
+	simulator *simulator
+	notReady  int
+	pending   [][]byte
+}
+
+func (b *i2cBus) Write(p []byte) (int, error) {
+	b.pending = append(b.pending, b.simulator.respond(p)...)
+	return len(p), nil
+}
+
+func (b *i2cBus) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0x00
+	}
+	if len(b.pending) == 0 || b.notReady > 0 {
+		b.notReady--
+		return len(p), nil
+	}
+	p[0] = i2cStatusReady
+	if len(p) > 1 {
+		copy(p[1:], b.pending[0])
+		b.pending = b.pending[1:]
+	}
+	return len(p), nil
+}
+
+func (b *i2cBus) Close() error {
+	return nil
+}
+
+func TestFrame(t *testing.T) {
+	frame, err := encodeFrame([]byte{hostToPN532, CommandGetFirmwareVersion})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x00, 0x00, 0xff, 0x02, 0xfe, 0xd4, 0x02, 0x2a, 0x00}, frame)
+	data, ack, err := decodeFrame(frame)
+	require.NoError(t, err)
+	assert.False(t, ack)
+	assert.Equal(t, []byte{hostToPN532, CommandGetFirmwareVersion}, data)
+	_, ack, err = decodeFrame(ackFrame)
+	require.NoError(t, err)
+	assert.True(t, ack)
+	// checksums.
+	_, _, err = decodeFrame([]byte{0x00, 0x00, 0xff, 0x02, 0xfe, 0xd4, 0x02, 0x2b, 0x00})
+	assert.Equal(t, ErrChecksum, err)
+	_, _, err = decodeFrame([]byte{0x00, 0x00, 0xff, 0x02, 0xfd, 0xd4, 0x02, 0x2a, 0x00})
+	assert.Equal(t, ErrChecksum, err)
+	// error frame.
+	_, _, err = decodeFrame([]byte{0x00, 0x00, 0xff, 0x01, 0xff, 0x7f, 0x81, 0x00})
+	assert.Equal(t, ErrApplication, err)
+	_, err = encodeFrame(make([]byte, 256))
+	assert.Error(t, err)
+	// reading skips leading bytes.
+	stream := append(append([]byte{0x55, 0x55, 0x00}, ackFrame...), frame...)
+	r := bufio.NewReader(bytes.NewReader(stream))
+	read, err := readFrame(r)
+	require.NoError(t, err)
+	assert.Equal(t, ackFrame, read)
+	read, err = readFrame(r)
+	require.NoError(t, err)
+	assert.Equal(t, frame, read)
+	_, err = readFrame(r)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestHSUDevice(t *testing.T) {
+	s := newSimulator()
+	device := newHSUDevice(s)
+	defer device.Close()
+
+	firmware, err := device.FirmwareVersion()
+	require.NoError(t, err)
+	assert.Equal(t, "PN532 v1.6", firmware.String())
+	require.NoError(t, device.InitiatorInit())
+
+	// no tag present.
+	target, err := device.InListPassiveTarget()
+	require.NoError(t, err)
+	assert.Nil(t, target)
+	_, err = device.ReadPages(4)
+	assert.Error(t, err)
+
+	// tag present.
+	s.present = true
+	target, err = device.InListPassiveTarget()
+	require.NoError(t, err)
+	require.NotNil(t, target)
+	assert.Equal(t, byte(1), target.Number)
+	assert.Equal(t, uint16(0x0044), target.SensRes)
+	assert.Equal(t, byte(0x00), target.SelRes)
+	assert.Equal(t, []byte{0x04, 0xa1, 0xb2, 0xc3, 0xd4, 0xe5, 0xf6}, target.UID)
+	assert.Nil(t, target.ATS)
+
+	// ndef message roundtrip.
+	message := ndef.EncodeMessage([]ndef.Record{ndef.NewURIRecord("piena://book/04A1B2C3")})
+	require.NoError(t, ndef.WriteType2Message(device, message))
+	read, err := ndef.ReadType2Message(device)
+	require.NoError(t, err)
+	assert.Equal(t, message, read)
+
+	// tag removed.
+	s.present = false
+	_, err = device.ReadPages(4)
+	assert.EqualError(t, err, "pn532: data exchange failed with status 0x01")
+
+	// unsupported commands.
+	_, err = device.Command(0x60, nil)
+	assert.Equal(t, ErrApplication, err)
+}
+
+func TestI2CDevice(t *testing.T) {
+	s := newSimulator()
+	device := NewDevice(NewI2CTransport(&i2cBus{simulator: s, notReady: 3}))
+	defer device.Close()
+	firmware, err := device.FirmwareVersion()
+	require.NoError(t, err)
+	assert.Equal(t, byte(0x32), firmware.IC)
+	s.present = true
+	target, err := device.InListPassiveTarget()
+	require.NoError(t, err)
+	require.NotNil(t, target)
+	assert.Len(t, target.UID, 7)
+}
+
+func TestTimeout(t *testing.T) {
+	s := newSimulator()
+	s.silent[CommandInListPassiveTarget] = true
+	device := newHSUDevice(s)
+	defer device.Close()
+	device.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	_, err := device.InListPassiveTarget()
+	assert.Equal(t, ErrTimeout, err)
+	assert.True(t, time.Since(start) < time.Second)
+	// the device keeps working.
+	_, err = device.FirmwareVersion()
+	assert.NoError(t, err)
+}
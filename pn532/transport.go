@@ -0,0 +1,146 @@
+package pn532
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	// i2cStatusReady is the status byte of a PN532 with data to read.
+	i2cStatusReady = 0x01
+	// i2cPollInterval is the interval the I2C status is polled with.
+	i2cPollInterval = 5 * time.Millisecond
+)
+
+// hsuWakeup wakes up a PN532 connected to a UART (high speed UART, HSU)
+// from power down mode. It is sent before the first frame.
+var hsuWakeup = []byte{0x55, 0x55, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+// ErrTimeout is returned if the PN532 does not answer in time.
+var ErrTimeout = errors.New("pn532: timeout")
+
+// Transport exchanges frames with a PN532.
+type Transport interface {
+	// Send sends the frame.
+	Send(frame []byte) error
+	// Receive returns the next frame sent by the PN532, waiting up to the
+	// timeout. Bytes following the frame may be returned as well.
+	Receive(timeout time.Duration) ([]byte, error)
+	// Close closes the connection.
+	Close() error
+}
+
+// hsuTransport exchanges frames over a UART byte stream.
+type hsuTransport struct {
+	port   io.ReadWriteCloser
+	awake  bool
+	frames chan []byte
+	err    error
+}
+
+// NewHSUTransport returns a transport for a PN532 connected to a UART. The
+// port has to be configured to 8N1 with the baud rate of the PN532, which
+// is 115200 by default. The transport owns the port and closes it.
+func NewHSUTransport(port io.ReadWriteCloser) Transport {
+	t := new(hsuTransport)
+	t.port = port
+	t.frames = make(chan []byte, 4)
+	go t.readFrames()
+	return t
+}
+
+func (t *hsuTransport) readFrames() {
+	defer close(t.frames)
+	r := bufio.NewReader(t.port)
+	for {
+		frame, err := readFrame(r)
+		if err == ErrChecksum {
+			// the frame is dropped, the command times out.
+			continue
+		}
+		if err != nil {
+			t.err = err
+			return
+		}
+		t.frames <- frame
+	}
+}
+
+func (t *hsuTransport) Send(frame []byte) error {
+	if !t.awake {
+		frame = append(append([]byte{}, hsuWakeup...), frame...)
+		t.awake = true
+	}
+	_, err := t.port.Write(frame)
+	return err
+}
+
+func (t *hsuTransport) Receive(timeout time.Duration) ([]byte, error) {
+	select {
+	case frame, ok := <-t.frames:
+		if !ok {
+			return nil, t.err
+		}
+		return frame, nil
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
+
+func (t *hsuTransport) Close() error {
+	return t.port.Close()
+}
+
+// i2cTransport exchanges frames over I2C. Every read starts with a status
+// byte telling whether the PN532 has data to read.
+type i2cTransport struct {
+	bus io.ReadWriteCloser
+}
+
+// NewI2CTransport returns a transport for a PN532 connected to an I2C bus.
+// Every write and read on the bus has to be a single transfer addressed to
+// the PN532, like with an I2C device file set to address 0x24. The
+// transport owns the bus and closes it.
+func NewI2CTransport(bus io.ReadWriteCloser) Transport {
+	t := new(i2cTransport)
+	t.bus = bus
+	return t
+}
+
+func (t *i2cTransport) Send(frame []byte) error {
+	_, err := t.bus.Write(frame)
+	return err
+}
+
+func (t *i2cTransport) Receive(timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	status := make([]byte, 1)
+	for {
+		if _, err := t.bus.Read(status); err != nil {
+			return nil, err
+		}
+		if status[0] == i2cStatusReady {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrTimeout
+		}
+		time.Sleep(i2cPollInterval)
+	}
+	// the frame is sent again with every read, after the status byte.
+	buffer := make([]byte, maxFrameLength+1)
+	n, err := t.bus.Read(buffer)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || buffer[0] != i2cStatusReady {
+		return nil, errors.New("pn532: i2c data not ready")
+	}
+	return buffer[1:n], nil
+}
+
+func (t *i2cTransport) Close() error {
+	return t.bus.Close()
+}
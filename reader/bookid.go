@@ -0,0 +1,135 @@
+package reader
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/michaelkleinhenz/piena/ndef"
+)
+
+// BookURIPrefix is the prefix of URI and text records carrying an
+// audiobook ID on the tag. Tags with such a record are identified by that
+// ID instead of their UID. An optional start track is given as query
+// parameter, e.g. piena://book/4711?track=3.
+const BookURIPrefix = "piena://book/"
+
+// BookURI returns the record content for the audiobook ID and start track.
+// A track of 0 omits the start track.
+func BookURI(id string, track int) string {
+	uri := BookURIPrefix + url.PathEscape(id)
+	if track > 0 {
+		uri += "?track=" + strconv.Itoa(track)
+	}
+	return uri
+}
+
+// parseBookURI returns the audiobook ID and start track of the record
+// content following BookURIPrefix.
+func parseBookURI(reference string) (string, int, error) {
+	path, query := reference, ""
+	if idx := strings.Index(reference, "?"); idx >= 0 {
+		path, query = reference[:idx], reference[idx+1:]
+	}
+	id, err := url.PathUnescape(path)
+	if err != nil {
+		return "", 0, err
+	}
+	if id == "" {
+		return "", 0, errors.New("empty audiobook id")
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", 0, err
+	}
+	track := 0
+	if values.Get("track") != "" {
+		track, err = strconv.Atoi(values.Get("track"))
+		if err != nil || track < 1 {
+			return "", 0, errors.New("invalid start track: " + values.Get("track"))
+		}
+	}
+	return id, track, nil
+}
+
+// readBookID reads the audiobook ID and start track from the NDEF message
+// of the tag. Returns an empty ID if the tag carries no audiobook ID, and
+// an error only if reading the tag failed.
+func readBookID(tag ndef.Type2Tag) (string, int, error) {
+	message, err := ndef.ReadType2Message(tag)
+	if err == ndef.ErrNoMessage {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	records, err := ndef.ParseMessage(message)
+	if err != nil {
+		log.Printf("[reader] error parsing ndef message: %s\n", err.Error())
+		return "", 0, nil
+	}
+	reference, ok := ndef.FindURIOrText(records, BookURIPrefix)
+	if !ok {
+		return "", 0, nil
+	}
+	id, track, err := parseBookURI(reference)
+	if err != nil {
+		log.Printf("[reader] error parsing audiobook reference %s: %s\n", reference, err.Error())
+		return "", 0, nil
+	}
+	return id, track, nil
+}
+
+// maxBookIDReadFailures is the number of polls reading the audiobook ID of a
+// placed tag may fail before the tag is identified by its UID.
+const maxBookIDReadFailures = 3
+
+// tagCache caches the result for the present tag, so its NDEF message is
+// only read once per placement.
+type tagCache struct {
+	uid      string
+	result   NfcReadResult
+	resolved bool
+	failures int
+}
+
+// resolve returns the result for the present tag. The audiobook ID and start
+// track are read from tag, nil for tags other than Type 2 tags. While reading
+// fails, no tag is reported, so a placement is not reported with the UID
+// first and the audiobook ID later. After maxBookIDReadFailures polls, the
+// tag is identified by its UID.
+func (c *tagCache) resolve(uid string, tag ndef.Type2Tag) *NfcReadResult {
+	if uid != c.uid {
+		c.clear()
+		c.uid = uid
+	}
+	if !c.resolved {
+		c.result = NfcReadResult{Result: NfcStateTagPresent, ID: uid}
+		if tag != nil {
+			bookID, track, err := readBookID(tag)
+			if err != nil {
+				log.Printf("[reader] error reading ndef message from tag %s: %s\n", uid, err.Error())
+				c.failures++
+				if c.failures < maxBookIDReadFailures {
+					return &NfcReadResult{Result: NfcStateTagNotPresent, ID: ""}
+				}
+				log.Printf("[reader] identifying tag %s by its uid\n", uid)
+			} else if bookID != "" {
+				log.Printf("[reader] tag %s carries audiobook id %s, start track %d\n", uid, bookID, track)
+				c.result.ID = bookID
+				c.result.Track = track
+				c.result.BookID = true
+			}
+		}
+		c.resolved = true
+	}
+	result := c.result
+	return &result
+}
+
+// clear forgets the tag, called when no tag is present.
+func (c *tagCache) clear() {
+	*c = tagCache{}
+}
@@ -0,0 +1,66 @@
+package reader
+
+import (
+	"time"
+
+	"github.com/michaelkleinhenz/piena/base"
+)
+
+// DebounceOptions configure how long a change of the tag has to persist
+// before it is reported, so glitches of the reader do not stop and restart
+// playback.
+type DebounceOptions struct {
+	// Present is the time a new tag has to be read before it is reported.
+	Present time.Duration
+	// Absent is the time a tag has to be missing before its removal is
+	// reported.
+	Absent time.Duration
+}
+
+// debouncer holds back changes until they persisted for the debounce
+// window.
+type debouncer struct {
+	options DebounceOptions
+	// candidate is the changed state waiting to be reported.
+	candidate *NfcReadResult
+	since     time.Time
+}
+
+// settled returns true if the polled result can be reported, that is it
+// does not differ from the reported result or differs for the debounce
+// window.
+func (d *debouncer) settled(reported *NfcReadResult, polled *NfcReadResult, now time.Time) bool {
+	if sameTagState(reported, polled) {
+		d.candidate = nil
+		return true
+	}
+	if !sameTagState(d.candidate, polled) {
+		d.candidate = polled
+		d.since = now
+	}
+	window := d.options.Present
+	if polled.Result == NfcStateTagNotPresent {
+		window = d.options.Absent
+	}
+	if now.Sub(d.since) < window {
+		return false
+	}
+	d.candidate = nil
+	return true
+}
+
+// reset drops the waiting change.
+func (d *debouncer) reset() {
+	d.candidate = nil
+}
+
+// sameTagState returns true if both results have the same tag or both no
+// tag. A nil result means no tag.
+func sameTagState(a *NfcReadResult, b *NfcReadResult) bool {
+	aPresent := a != nil && a.Result == NfcStateTagPresent
+	bPresent := b != nil && b.Result == NfcStateTagPresent
+	if !aPresent || !bPresent {
+		return aPresent == bPresent
+	}
+	return base.TagIDsMatch(a.ID, b.ID) && a.Track == b.Track
+}
@@ -0,0 +1,78 @@
+package reader
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// eviocgrab is the ioctl grabbing an evdev input device.
+	eviocgrab = 0x40044590
+	// cbaud masks the baud rate bits of the termios control flags.
+	cbaud = 0x100f
+	// i2cSlave is the ioctl setting the address of an I2C device file.
+	i2cSlave = 0x0703
+)
+
+// serialBaudRates maps baud rates to their termios constants.
+var serialBaudRates = map[int]uint32{
+	1200:   syscall.B1200,
+	2400:   syscall.B2400,
+	4800:   syscall.B4800,
+	9600:   syscall.B9600,
+	19200:  syscall.B19200,
+	38400:  syscall.B38400,
+	57600:  syscall.B57600,
+	115200: syscall.B115200,
+}
+
+func grabInputDevice(device *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, device.Fd(), eviocgrab, 1)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// configureSerialPort sets the port to raw 8N1 mode with the baud rate.
+func configureSerialPort(port *os.File, baudRate int) error {
+	speed, ok := serialBaudRates[baudRate]
+	if !ok {
+		return fmt.Errorf("unsupported baud rate: %d", baudRate)
+	}
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, port.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	if errno != 0 {
+		return errno
+	}
+	termios.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	termios.Oflag &^= syscall.OPOST
+	termios.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	termios.Cflag &^= syscall.CSIZE | syscall.PARENB | syscall.CSTOPB | cbaud
+	// the speed is only set in the control flags, as termios has no speed
+	// fields on mips.
+	termios.Cflag |= syscall.CS8 | syscall.CREAD | syscall.CLOCAL | speed
+	termios.Cc[syscall.VMIN] = 1
+	termios.Cc[syscall.VTIME] = 0
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, port.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&termios)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openI2CDevice opens the I2C device file for transfers to the address.
+func openI2CDevice(path string, address int) (*os.File, error) {
+	device, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, device.Fd(), i2cSlave, uintptr(address))
+	if errno != 0 {
+		device.Close()
+		return nil, errno
+	}
+	return device, nil
+}
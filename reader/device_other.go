@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package reader
+
+import (
+	"errors"
+	"os"
+)
+
+func grabInputDevice(device *os.File) error {
+	return errors.New("grabbing input devices is only supported on linux")
+}
+
+// configureSerialPort leaves the port configuration untouched, it has to
+// be configured with stty.
+func configureSerialPort(port *os.File, baudRate int) error {
+	return nil
+}
+
+func openI2CDevice(path string, address int) (*os.File, error) {
+	return nil, errors.New("i2c devices are only supported on linux")
+}
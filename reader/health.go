@@ -0,0 +1,61 @@
+package reader
+
+import (
+	"fmt"
+	"time"
+)
+
+// RecoveryOptions configure how the reader recovers from a failing source.
+type RecoveryOptions struct {
+	// MaxFailures is the number of consecutive errors after which the
+	// source is closed and reopened. 0 disables reopening.
+	MaxFailures int
+	// InitialBackoff is the delay before the first reopen attempt. It is
+	// doubled with every failed attempt, up to MaxBackoff.
+	InitialBackoff time.Duration
+	// MaxBackoff is the maximum delay between reopen attempts.
+	MaxBackoff time.Duration
+}
+
+// DefaultRecoveryOptions are used for hardware readers.
+var DefaultRecoveryOptions = RecoveryOptions{
+	MaxFailures:    5,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+}
+
+// SourceOpener opens a tag source. It is called again to reopen the source
+// after failures.
+type SourceOpener func() (TagSource, error)
+
+// Health describes the state of the reader for status reporting.
+type Health struct {
+	// Connected is true while the source is open.
+	Connected bool
+	// ConsecutiveFailures is the number of errors since the last
+	// successful poll.
+	ConsecutiveFailures int
+	// LastError is the last error of the source, nil if none occurred.
+	LastError error
+	// LastErrorAt is the time of the last error.
+	LastErrorAt time.Time
+	// Reconnects is the number of times the source was reopened.
+	Reconnects int
+}
+
+func (h Health) String() string {
+	lastError := "none"
+	if h.LastError != nil {
+		lastError = fmt.Sprintf("%s at %s", h.LastError.Error(), h.LastErrorAt.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("connected=%t failures=%d reconnects=%d last error=%s", h.Connected, h.ConsecutiveFailures, h.Reconnects, lastError)
+}
+
+// nextBackoff doubles the backoff up to the maximum.
+func (o RecoveryOptions) nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > o.MaxBackoff {
+		return o.MaxBackoff
+	}
+	return backoff
+}
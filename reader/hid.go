@@ -0,0 +1,95 @@
+package reader
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// evKey is the evdev event type of key events.
+	evKey = 0x01
+	// keyPressed is the value of key press events.
+	keyPressed = 1
+	// keyEnter and keyKeypadEnter end an ID typed by a reader.
+	keyEnter       = 28
+	keyKeypadEnter = 96
+)
+
+// inputEventSize is the size of struct input_event, which starts with a
+// struct timeval made of two longs.
+var inputEventSize = 2*strconv.IntSize/8 + 8
+
+// hidKeys maps evdev key codes to the characters typed by readers.
+var hidKeys = map[uint16]byte{
+	2: '1', 3: '2', 4: '3', 5: '4', 6: '5', 7: '6', 8: '7', 9: '8', 10: '9', 11: '0',
+	16: 'q', 17: 'w', 18: 'e', 19: 'r', 20: 't', 21: 'y', 22: 'u', 23: 'i', 24: 'o', 25: 'p',
+	30: 'a', 31: 's', 32: 'd', 33: 'f', 34: 'g', 35: 'h', 36: 'j', 37: 'k', 38: 'l',
+	44: 'z', 45: 'x', 46: 'c', 47: 'v', 48: 'b', 49: 'n', 50: 'm',
+	71: '7', 72: '8', 73: '9', 75: '4', 76: '5', 77: '6', 79: '1', 80: '2', 81: '3', 82: '0',
+}
+
+// HIDSource reads tag IDs from readers acting as keyboard, which type the
+// ID followed by enter. The input device is grabbed, so the IDs are not
+// typed into other programs.
+type HIDSource struct {
+	readingSource
+	device *os.File
+}
+
+// NewHIDSource opens the evdev input device at the given path, e.g.
+// /dev/input/event0. See readingSource for the removal timeout.
+func NewHIDSource(path string, removalTimeout time.Duration) (*HIDSource, error) {
+	device, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	err = grabInputDevice(device)
+	if err != nil {
+		log.Printf("[reader] grabbing input device %s failed, tag IDs may be typed into other programs: %s\n", path, err.Error())
+	}
+	log.Printf("[reader] opened hid reader device %s\n", path)
+	s := new(HIDSource)
+	s.device = device
+	s.removalTimeout = removalTimeout
+	go s.readEvents(device)
+	return s, nil
+}
+
+func (s *HIDSource) readEvents(in io.Reader) {
+	var id strings.Builder
+	event := make([]byte, inputEventSize)
+	for {
+		if _, err := io.ReadFull(in, event); err != nil {
+			s.fail(err)
+			return
+		}
+		// type, code and value follow the timeval.
+		eventType := binary.LittleEndian.Uint16(event[inputEventSize-8:])
+		code := binary.LittleEndian.Uint16(event[inputEventSize-6:])
+		value := int32(binary.LittleEndian.Uint32(event[inputEventSize-4:]))
+		if eventType != evKey || value != keyPressed {
+			continue
+		}
+		if code == keyEnter || code == keyKeypadEnter {
+			if id.Len() > 0 {
+				s.report(id.String())
+				id.Reset()
+			}
+			continue
+		}
+		if char, ok := hidKeys[code]; ok {
+			id.WriteByte(char)
+		}
+	}
+}
+
+// Close closes the input device.
+func (s *HIDSource) Close() error {
+	s.markClosed()
+	return s.device.Close()
+}
@@ -0,0 +1,132 @@
+//go:build libnfc
+// +build libnfc
+
+package reader
+
+import (
+	"log"
+
+	"github.com/michaelkleinhenz/piena/ndef"
+	"github.com/michaelkleinhenz/piena/nfc"
+)
+
+// LibnfcSupported is true if piena is built with libnfc support.
+const LibnfcSupported = true
+
+// pollModulations are the modulations polled for tags, in order. Those not
+// supported by the device are skipped.
+var pollModulations = []nfc.Modulation{
+	nfc.Modulation{Type: nfc.ISO14443a, BaudRate: nfc.Nbr106},
+	nfc.Modulation{Type: nfc.ISO14443b, BaudRate: nfc.Nbr106},
+	nfc.Modulation{Type: nfc.Felica, BaudRate: nfc.Nbr212},
+	nfc.Modulation{Type: nfc.Felica, BaudRate: nfc.Nbr424},
+	nfc.Modulation{Type: nfc.Jewel, BaudRate: nfc.Nbr106},
+}
+
+// ListLibnfcDevices returns the connection strings of the libnfc devices.
+func ListLibnfcDevices() ([]string, error) {
+	return nfc.ListDevices()
+}
+
+// LibnfcSource reads tags from a reader supported by libnfc. For Type 2
+// tags carrying an audiobook ID in their NDEF message, that ID is returned
+// instead of the UID.
+type LibnfcSource struct {
+	device nfc.Device
+	// modulations are the supported modulations polled for tags.
+	modulations []nfc.Modulation
+	// tags caches the result for the present tag.
+	tags tagCache
+}
+
+// NewLibnfcSource opens the libnfc device with the given connection string.
+// An empty connection string opens the first device found.
+func NewLibnfcSource(connection string) (*LibnfcSource, error) {
+	log.Printf("[reader] using libnfc version %s\n", nfc.Version())
+	pnd, err := nfc.Open(connection)
+	if err != nil {
+		return nil, err
+	}
+	if err := pnd.InitiatorInit(); err != nil {
+		pnd.Close()
+		return nil, err
+	}
+	log.Printf("[reader] opened nfc reader device %s\n", pnd.Connection())
+	pnd.SetPropertyBool(nfc.InfiniteSelect, false)
+	s := new(LibnfcSource)
+	s.device = pnd
+	s.modulations = supportedModulations(pnd)
+	return s, nil
+}
+
+// supportedModulations returns the poll modulations supported by the
+// device. If the device can not tell, ISO14443a is used.
+func supportedModulations(pnd nfc.Device) []nfc.Modulation {
+	modulations := []nfc.Modulation{}
+	types, err := pnd.SupportedModulations(nfc.InitiatorMode)
+	if err != nil {
+		log.Printf("[reader] error getting supported modulations, using ISO14443a only: %s\n", err.Error())
+		return pollModulations[:1]
+	}
+	for _, modulation := range pollModulations {
+		if !containsInt(types, modulation.Type) {
+			continue
+		}
+		baudRates, err := pnd.SupportedBaudRates(modulation.Type)
+		if err == nil && containsInt(baudRates, modulation.BaudRate) {
+			modulations = append(modulations, modulation)
+		}
+	}
+	if len(modulations) == 0 {
+		return pollModulations[:1]
+	}
+	log.Printf("[reader] polling %d modulations\n", len(modulations))
+	return modulations
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Poll selects a passive target of any supported modulation and returns
+// its ID.
+func (s *LibnfcSource) Poll() *NfcReadResult {
+	target, err := s.selectTarget()
+	if err != nil {
+		return &NfcReadResult{Result: NfcStateError, ID: "", Err: err}
+	}
+	if target == nil {
+		s.tags.clear()
+		return &NfcReadResult{Result: NfcStateTagNotPresent, ID: "", Err: err}
+	}
+	tagID, err := nfc.TargetID(target)
+	if err != nil {
+		return &NfcReadResult{Result: NfcStateError, ID: "", Err: err}
+	}
+	var tag ndef.Type2Tag
+	if card, ok := target.(*nfc.ISO14443aTarget); ok && card.Sak == type2SAK {
+		tag = s.device
+	}
+	return s.tags.resolve(tagID, tag)
+}
+
+// selectTarget returns the first target found polling the modulations.
+func (s *LibnfcSource) selectTarget() (nfc.Target, error) {
+	for _, modulation := range s.modulations {
+		target, err := s.device.InitiatorSelectPassiveTarget(modulation, nil)
+		if err != nil || target != nil {
+			return target, err
+		}
+	}
+	return nil, nil
+}
+
+// Close closes the device.
+func (s *LibnfcSource) Close() error {
+	return s.device.Close()
+}
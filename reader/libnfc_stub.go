@@ -0,0 +1,43 @@
+//go:build !libnfc
+// +build !libnfc
+
+package reader
+
+import (
+	"errors"
+)
+
+// LibnfcSupported is true if piena is built with libnfc support.
+const LibnfcSupported = false
+
+// errNoLibnfc is returned by libnfc functions without libnfc support.
+var errNoLibnfc = errors.New("piena is built without libnfc support, rebuild with -tags libnfc")
+
+// ListLibnfcDevices returns an error without libnfc support.
+func ListLibnfcDevices() ([]string, error) {
+	return nil, errNoLibnfc
+}
+
+// LibnfcSource reads tags from a reader supported by libnfc. Without libnfc
+// support, it can not be opened.
+type LibnfcSource struct{}
+
+// NewLibnfcSource returns an error without libnfc support.
+func NewLibnfcSource(connection string) (*LibnfcSource, error) {
+	return nil, errNoLibnfc
+}
+
+// Poll returns an error without libnfc support.
+func (s *LibnfcSource) Poll() *NfcReadResult {
+	return &NfcReadResult{Result: NfcStateError, Err: errNoLibnfc}
+}
+
+// Close does nothing without libnfc support.
+func (s *LibnfcSource) Close() error {
+	return nil
+}
+
+// WriteTag returns an error without libnfc support.
+func WriteTag(connection string, options WriteOptions) (string, error) {
+	return "", errNoLibnfc
+}
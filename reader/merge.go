@@ -0,0 +1,26 @@
+package reader
+
+import (
+	"sync"
+)
+
+// Merge returns a channel receiving the results of all channels. It is
+// closed after all channels are closed.
+func Merge(channels ...chan *NfcReadResult) chan *NfcReadResult {
+	merged := make(chan *NfcReadResult)
+	var wg sync.WaitGroup
+	wg.Add(len(channels))
+	for _, c := range channels {
+		go func(c chan *NfcReadResult) {
+			defer wg.Done()
+			for result := range c {
+				merged <- result
+			}
+		}(c)
+	}
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+	return merged
+}
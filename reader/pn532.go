@@ -0,0 +1,92 @@
+package reader
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/michaelkleinhenz/piena/ndef"
+	"github.com/michaelkleinhenz/piena/pn532"
+)
+
+const (
+	// type2SAK is the SAK of Type 2 tags like NTAG21x and MIFARE Ultralight.
+	type2SAK = 0x00
+	// pn532I2CAddress is the I2C address of the PN532.
+	pn532I2CAddress = 0x24
+	// pn532BaudRate is the default baud rate of the PN532 UART.
+	pn532BaudRate = 115200
+)
+
+// PN532Source reads ISO14443A tags from a PN532 connected to a UART or an
+// I2C bus, without libnfc. Like with LibnfcSource, the audiobook ID stored
+// on Type 2 tags is returned instead of the UID.
+type PN532Source struct {
+	device *pn532.Device
+	// tags caches the result for the present tag.
+	tags tagCache
+}
+
+// NewPN532Source opens the PN532 at the given device path. I2C device
+// files (/dev/i2c-N) are used as I2C bus, other paths as UART with the
+// given baud rate, 0 uses the default of 115200.
+func NewPN532Source(path string, baudRate int) (*PN532Source, error) {
+	var transport pn532.Transport
+	if strings.HasPrefix(path, "/dev/i2c") {
+		bus, err := openI2CDevice(path, pn532I2CAddress)
+		if err != nil {
+			return nil, err
+		}
+		transport = pn532.NewI2CTransport(bus)
+	} else {
+		if baudRate == 0 {
+			baudRate = pn532BaudRate
+		}
+		port, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := configureSerialPort(port, baudRate); err != nil {
+			port.Close()
+			return nil, err
+		}
+		transport = pn532.NewHSUTransport(port)
+	}
+	device := pn532.NewDevice(transport)
+	firmware, err := device.FirmwareVersion()
+	if err == nil {
+		err = device.InitiatorInit()
+	}
+	if err != nil {
+		device.Close()
+		return nil, fmt.Errorf("error initializing pn532 at %s: %s", path, err.Error())
+	}
+	log.Printf("[reader] opened %s reader device %s\n", firmware, path)
+	s := new(PN532Source)
+	s.device = device
+	return s, nil
+}
+
+// Poll selects a passive ISO14443A target and returns its ID.
+func (s *PN532Source) Poll() *NfcReadResult {
+	target, err := s.device.InListPassiveTarget()
+	if err != nil {
+		return &NfcReadResult{Result: NfcStateError, Err: err}
+	}
+	if target == nil {
+		s.tags.clear()
+		return &NfcReadResult{Result: NfcStateTagNotPresent}
+	}
+	uid := fmt.Sprintf("%X", target.UID)
+	var tag ndef.Type2Tag
+	if target.SelRes == type2SAK {
+		tag = s.device
+	}
+	return s.tags.resolve(uid, tag)
+}
+
+// Close closes the device.
+func (s *PN532Source) Close() error {
+	return s.device.Close()
+}
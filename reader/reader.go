@@ -1,13 +1,14 @@
 package reader
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"log"
 	"strconv"
+	"sync"
 	"time"
 
-	"github.com/michaelkleinhenz/piena/nfc"
+	"github.com/michaelkleinhenz/piena/base"
 )
 
 const (
@@ -19,127 +20,213 @@ const (
 	NfcStateTagPresent = 1
 )
 
-var (
-	// TestMode signals if the modules is in testing mode.
-	TestMode bool = false
-	// TestModeResult is the returned result state in testing mode.
-	TestModeResult int
-	// TestModeID is the returned id in testing mode.
-	TestModeID string
-)
-
 // NfcReadResult is the result data structure.
 type NfcReadResult struct {
 	Result int
 	ID     string
+	// Track is the start track stored on the tag, 0 if none.
+	Track int
+	// BookID is true if ID is the audiobook ID stored on the tag instead of
+	// the UID. Audiobook IDs are used as they are, UIDs are normalized.
+	BookID bool
 	Err    error
+	// Reader is the name of the reader, e.g. its connection string.
+	Reader string
+}
+
+// Options configure a reader.
+type Options struct {
+	// Recovery configures reopening failing sources.
+	Recovery RecoveryOptions
+	// Debounce configures filtering short changes of the tag.
+	Debounce DebounceOptions
 }
 
-// NfcReader is the hardware reader interface.
+// DefaultOptions are used for hardware readers. Removals are reported after
+// the tag is missing for half a second.
+var DefaultOptions = Options{
+	Recovery: DefaultRecoveryOptions,
+	Debounce: DebounceOptions{Absent: 500 * time.Millisecond},
+}
+
+// NfcReader reports changes of the tags on a tag source.
 type NfcReader struct {
-	terminateReader      bool
+	name                 string
+	open                 SourceOpener
+	options              RecoveryOptions
+	debouncer            debouncer
 	currentNfcReadResult *NfcReadResult
 	channel              chan *NfcReadResult
+	done                 chan struct{}
+	closeOnce            sync.Once
+	mutex                sync.Mutex
+	health               Health
+}
+
+// NewNfcReader returns a new nfcReader instance reading from the first
+// libnfc device. The device is opened in the background and reopened if it
+// keeps failing, see Health for its state.
+func NewNfcReader() (*NfcReader, chan *NfcReadResult) {
+	return NewRecoveringReader(context.Background(), "", func() (TagSource, error) {
+		return NewLibnfcSource("")
+	}, DefaultOptions)
+}
+
+// NewReader returns a new reader instance reading from the given source.
+// The reader owns the source and closes it when terminated. The source is
+// not reopened on failures and changes are not debounced.
+func NewReader(source TagSource) (*NfcReader, chan *NfcReadResult) {
+	opened := false
+	return NewRecoveringReader(context.Background(), "", func() (TagSource, error) {
+		if opened {
+			return nil, errors.New("source can not be reopened")
+		}
+		opened = true
+		return source, nil
+	}, Options{})
 }
 
-// NewNfcReader eturns a new nfcReader instance.
-func NewNfcReader() (*NfcReader, chan *NfcReadResult, error) {
-	log.Printf("[reader] using libnfc version %s\n", nfc.Version())
+// NewRecoveringReader returns a new reader instance with the given name
+// reading from the sources returned by open. Failing to open is retried
+// with exponential backoff, and the source is closed and reopened after the
+// configured number of consecutive errors. Changes of the tag are reported
+// after they persisted for the debounce windows. The reader is closed when
+// the context is done.
+func NewRecoveringReader(ctx context.Context, name string, open SourceOpener, options Options) (*NfcReader, chan *NfcReadResult) {
 	r := new(NfcReader)
-	r.terminateReader = false
-	pnd, err := r.initNfcHardware()
-	if err != nil {
-		return nil, nil, err
-	}
+	r.name = name
+	r.open = open
+	r.options = options.Recovery
+	r.debouncer.options = options.Debounce
 	r.channel = make(chan *NfcReadResult)
-	go r.runLoop(pnd, r.channel)
-	return r, r.channel, nil
+	r.done = make(chan struct{})
+	go r.runLoop(r.channel)
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.Close()
+		case <-r.done:
+		}
+	}()
+	return r, r.channel
 }
 
 // Close terminates the reader hardware.
 func (r *NfcReader) Close() {
 	log.Println("[reader] terminating reader instance")
-	r.terminateReader = true
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
 }
 
-func (r *NfcReader) initNfcHardware() (*nfc.Device, error) {
-	if TestMode {
-		log.Println("[reader] nfc module in test mode, returning dummy device")
-		return &nfc.Device{}, nil
-	}
-	pnd, err := nfc.Open("")
-	if err != nil {
-		return nil, err
-	}
-	if err := pnd.InitiatorInit(); err != nil {
-		return nil, err
-	}
-	log.Printf("[reader] opened nfc reader device %s\n", pnd.Connection())
-	pnd.SetPropertyBool(nfc.InfiniteSelect, false)
-	return &pnd, nil
+// Name returns the name of the reader.
+func (r *NfcReader) Name() string {
+	return r.name
 }
 
-func (r *NfcReader) toString(t nfc.Target) (string, error) {
-	if card, ok := t.(*nfc.ISO14443aTarget); ok {
-		return fmt.Sprintf("%#x", card.UID), nil
-	}
-	return "", errors.New("error converting target to string")
+// Health returns the current health of the reader.
+func (r *NfcReader) Health() Health {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.health
 }
 
-func (r *NfcReader) getCurrentNFCTagID(pnd *nfc.Device) *NfcReadResult {
-	if TestMode {
-		log.Printf("[reader] getCurrentNFCTagID returning dummy result state=%d id=%s\n", TestModeResult, TestModeID)
-		time.Sleep(500 * time.Millisecond)
-		return &NfcReadResult{
-			Result: TestModeResult,
-			ID:     TestModeID,
-			Err:    nil,
-		}
-	}
-	target, err := pnd.InitiatorSelectPassiveTarget(nfc.Modulation{Type: nfc.ISO14443a, BaudRate: nfc.Nbr106}, nil)
-	if err != nil {
-		return &NfcReadResult{Result: NfcStateError, ID: "", Err: err}
-	}
-	if target == nil {
-		return &NfcReadResult{Result: NfcStateTagNotPresent, ID: "", Err: err}
-	}
-	tagID, err := r.toString(target)
-	if err != nil {
-		return &NfcReadResult{Result: NfcStateError, ID: "", Err: err}
-	}
-	return &NfcReadResult{Result: NfcStateTagPresent, ID: tagID, Err: nil}
-}
-
-func (r *NfcReader) runLoop(pnd *nfc.Device, c chan *NfcReadResult) {
-	// when this terminates, we also close the channel and device.
+func (r *NfcReader) runLoop(c chan *NfcReadResult) {
+	var source TagSource
+	// when this terminates, we also close the channel and source.
 	defer func() {
 		close(c)
-		if !TestMode {
-			pnd.Close()
+		if source != nil {
+			source.Close()
 		}
 	}()
-	// as long as terminateReader is false, we run in a loop.
-	for !r.terminateReader {
-		readResult := r.getCurrentNFCTagID(pnd)
+	backoff := r.options.InitialBackoff
+	opened := false
+	// as long as the reader is not closed, we run in a loop.
+loop:
+	for !r.isClosed() {
+		if source == nil {
+			var err error
+			source, err = r.open()
+			if err != nil {
+				log.Printf("[reader] error opening reader, retrying in %s: %s\n", backoff, err.Error())
+				r.updateHealth(func(h *Health) {
+					h.LastError, h.LastErrorAt = err, time.Now()
+				})
+				source = nil
+				if !r.sleep(backoff) {
+					break
+				}
+				backoff = r.options.nextBackoff(backoff)
+				continue
+			}
+			r.updateHealth(func(h *Health) {
+				h.Connected = true
+				if opened {
+					h.Reconnects++
+				}
+			})
+			opened = true
+		}
+		readResult := source.Poll()
+		if !readResult.BookID {
+			readResult.ID = base.NormalizeTagID(readResult.ID)
+		}
+		readResult.Reader = r.name
 		if readResult.Err != nil {
-			// read returned an error, remove current result, return error.
+			// read returned an error, return error. The current result is
+			// kept, so a tag removed meanwhile is reported once reading
+			// works again, also from a reopened source.
 			log.Printf("[reader] error reading from nfc reader: %s\n", readResult.Err.Error())
-			r.currentNfcReadResult = nil
-			c <- readResult
-		} else {
-			// read returned no error, check status.
-			switch readResult.Result {
-			case NfcStateTagPresent:
-				if !r.safeCompareReadResults(r.currentNfcReadResult, readResult) {
-					log.Printf("[reader] detected updated ID on reader (old=%s, new=%s)\n", r.serialize(r.currentNfcReadResult), r.serialize(readResult))
-					r.currentNfcReadResult = readResult
-					c <- readResult
+			r.debouncer.reset()
+			failures := 0
+			r.updateHealth(func(h *Health) {
+				h.ConsecutiveFailures++
+				h.LastError, h.LastErrorAt = readResult.Err, time.Now()
+				failures = h.ConsecutiveFailures
+			})
+			if !r.send(c, readResult) {
+				break
+			}
+			if r.options.MaxFailures > 0 && failures >= r.options.MaxFailures {
+				// the device is likely wedged, reopen it.
+				log.Printf("[reader] %d consecutive errors, reopening reader in %s\n", failures, backoff)
+				source.Close()
+				source = nil
+				r.updateHealth(func(h *Health) {
+					h.Connected = false
+					h.ConsecutiveFailures = 0
+				})
+				if !r.sleep(backoff) {
+					break
 				}
-			case NfcStateTagNotPresent:
-				if r.currentNfcReadResult != nil {
-					log.Printf("[reader] detected removed tag on reader (old=%s)\n", r.serialize(r.currentNfcReadResult))
-					r.currentNfcReadResult = nil
-					c <- readResult
+				backoff = r.options.nextBackoff(backoff)
+			}
+			continue
+		}
+		backoff = r.options.InitialBackoff
+		r.updateHealth(func(h *Health) {
+			h.ConsecutiveFailures = 0
+		})
+		if !r.debouncer.settled(r.currentNfcReadResult, readResult, time.Now()) {
+			continue
+		}
+		// read returned no error, check status.
+		switch readResult.Result {
+		case NfcStateTagPresent:
+			if !r.safeCompareReadResults(r.currentNfcReadResult, readResult) {
+				log.Printf("[reader] detected updated ID on reader (old=%s, new=%s)\n", r.serialize(r.currentNfcReadResult), r.serialize(readResult))
+				r.currentNfcReadResult = readResult
+				if !r.send(c, readResult) {
+					break loop
+				}
+			}
+		case NfcStateTagNotPresent:
+			if r.currentNfcReadResult != nil {
+				log.Printf("[reader] detected removed tag on reader (old=%s)\n", r.serialize(r.currentNfcReadResult))
+				r.currentNfcReadResult = nil
+				if !r.send(c, readResult) {
+					break loop
 				}
 			}
 		}
@@ -147,6 +234,43 @@ func (r *NfcReader) runLoop(pnd *nfc.Device, c chan *NfcReadResult) {
 	log.Println("[reader] terminated reader instance")
 }
 
+func (r *NfcReader) isClosed() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// send passes the result to the channel. Returns false if the reader was
+// closed while waiting.
+func (r *NfcReader) send(c chan *NfcReadResult, result *NfcReadResult) bool {
+	select {
+	case c <- result:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// sleep waits for the given duration. Returns false if the reader was
+// closed while waiting.
+func (r *NfcReader) sleep(duration time.Duration) bool {
+	select {
+	case <-time.After(duration):
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+func (r *NfcReader) updateHealth(update func(*Health)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	update(&r.health)
+}
+
 func (r *NfcReader) serialize(a *NfcReadResult) string {
 	if a == nil {
 		return "nil"
@@ -161,7 +285,7 @@ func (r *NfcReader) safeCompareReadResults(a *NfcReadResult, b *NfcReadResult) b
 	if a == nil && b == nil {
 		return true
 	}
-	if a.Result == b.Result && a.ID == b.ID {
+	if a.Result == b.Result && base.TagIDsMatch(a.ID, b.ID) && a.Track == b.Track {
 		return true
 	}
 	return false
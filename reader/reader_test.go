@@ -1,40 +1,503 @@
 package reader
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/michaelkleinhenz/piena/ndef/ndeftest"
 	"github.com/stretchr/testify/require"
 )
 
 func TestNfcReader(t *testing.T) {
-	TestMode = true
-	TestModeResult = NfcStateTagNotPresent
-	TestModeID = ""
-	reader, channel, err := NewNfcReader()
+	source := NewScriptedSource([]ScriptedEvent{
+		// add tag to reader.
+		ScriptedEvent{After: 20 * time.Millisecond, Result: NfcStateTagPresent, ID: "12345678"},
+		// update tag.
+		ScriptedEvent{After: 50 * time.Millisecond, Result: NfcStateTagPresent, ID: "ABCDEF"},
+		// reading fails.
+		ScriptedEvent{After: 50 * time.Millisecond, Err: errors.New("read failed")},
+		// remove tag.
+		ScriptedEvent{After: 50 * time.Millisecond, Result: NfcStateTagNotPresent},
+	})
+	reader, channel := NewReader(source)
 
 	// basic saneness.
-	require.NoError(t, err)
 	require.NotNil(t, channel)
 	require.NotNil(t, reader)
 
-    // add tag to reader.
-	TestModeResult = NfcStateTagPresent
-    TestModeID = "12345678"
-    result := <-channel
-    require.Equal(t, TestModeID, result.ID)
-
-    // update tag.
-	TestModeResult = NfcStateTagPresent
-    TestModeID = "ABCDEF"
-    result = <-channel
-    require.Equal(t, TestModeID, result.ID)
-
-    // remove tag.
-    TestModeResult = NfcStateTagNotPresent
-    TestModeID = ""
-    result = <-channel
-    require.Equal(t, NfcStateTagNotPresent, result.Result)
-
-    // terminate reader instance
-    reader.Close()
+	result := <-channel
+	require.Equal(t, NfcStateTagPresent, result.Result)
+	require.Equal(t, "12345678", result.ID)
+
+	result = <-channel
+	require.Equal(t, NfcStateTagPresent, result.Result)
+	require.Equal(t, "ABCDEF", result.ID)
+
+	result = <-channel
+	require.Equal(t, NfcStateError, result.Result)
+	require.Error(t, result.Err)
+
+	// the removal after the error is reported.
+	result = <-channel
+	require.Equal(t, NfcStateTagNotPresent, result.Result)
+	require.True(t, source.Finished())
+
+	// terminate reader instance
+	reader.Close()
+	for range channel {
+	}
+	require.True(t, source.Closed())
+}
+
+func TestNormalizeIDs(t *testing.T) {
+	source := NewScriptedSource([]ScriptedEvent{
+		ScriptedEvent{After: 20 * time.Millisecond, Result: NfcStateTagPresent, ID: "04:a1:b2:c3"},
+		// audiobook IDs are not UIDs and used as they are.
+		ScriptedEvent{After: 50 * time.Millisecond, Result: NfcStateTagPresent, ID: "book-0x4711", BookID: true},
+	})
+	reader, channel := NewReader(source)
+	defer reader.Close()
+	require.Equal(t, "04A1B2C3", (<-channel).ID)
+	result := <-channel
+	require.Equal(t, "book-0x4711", result.ID)
+	require.True(t, result.BookID)
+}
+
+func TestReaderRecovery(t *testing.T) {
+	options := Options{Recovery: RecoveryOptions{MaxFailures: 2, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond}}
+	failing := NewScriptedSource([]ScriptedEvent{
+		ScriptedEvent{Err: errors.New("read failed")},
+		ScriptedEvent{Err: errors.New("read failed")},
+	})
+	working := NewScriptedSource([]ScriptedEvent{
+		ScriptedEvent{Result: NfcStateTagPresent, ID: "12345678"},
+	})
+	openErrors := 2
+	var sources []*ScriptedSource
+	reader, channel := NewRecoveringReader(context.Background(), "test", func() (TagSource, error) {
+		if openErrors > 0 {
+			openErrors--
+			return nil, errors.New("no device")
+		}
+		if len(sources) == 0 {
+			sources = append(sources, failing)
+			return failing, nil
+		}
+		sources = append(sources, working)
+		return working, nil
+	}, options)
+	require.False(t, reader.Health().Connected)
+
+	// two errors close the failing source.
+	result := <-channel
+	require.Equal(t, NfcStateError, result.Result)
+	require.Equal(t, 1, reader.Health().ConsecutiveFailures)
+	result = <-channel
+	require.Equal(t, NfcStateError, result.Result)
+
+	// the reopened source reports the tag.
+	result = <-channel
+	require.Equal(t, NfcStateTagPresent, result.Result)
+	require.Equal(t, "12345678", result.ID)
+	require.Equal(t, "test", result.Reader)
+	require.True(t, failing.Closed())
+	health := reader.Health()
+	require.True(t, health.Connected)
+	require.Equal(t, 1, health.Reconnects)
+	require.Equal(t, 0, health.ConsecutiveFailures)
+	require.EqualError(t, health.LastError, "read failed")
+
+	reader.Close()
+	for range channel {
+	}
+	require.True(t, working.Closed())
+}
+
+func TestRemovalAfterReopen(t *testing.T) {
+	options := Options{Recovery: RecoveryOptions{MaxFailures: 1, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond}}
+	sources := []*ScriptedSource{
+		NewScriptedSource([]ScriptedEvent{
+			ScriptedEvent{Result: NfcStateTagPresent, ID: "12345678"},
+			ScriptedEvent{After: 50 * time.Millisecond, Err: errors.New("read failed")},
+		}),
+		// the tag was removed while the source was reopened.
+		NewScriptedSource(nil),
+	}
+	reader, channel := NewRecoveringReader(context.Background(), "test", func() (TagSource, error) {
+		source := sources[0]
+		sources = sources[1:]
+		return source, nil
+	}, options)
+	defer reader.Close()
+	require.Equal(t, NfcStateTagPresent, (<-channel).Result)
+	require.Equal(t, NfcStateError, (<-channel).Result)
+	require.Equal(t, NfcStateTagNotPresent, (<-channel).Result)
+	require.Equal(t, 1, reader.Health().Reconnects)
+}
+
+func TestReaderNotReopened(t *testing.T) {
+	source := NewScriptedSource([]ScriptedEvent{
+		ScriptedEvent{Err: errors.New("read failed")},
+		ScriptedEvent{After: 20 * time.Millisecond, Result: NfcStateTagPresent, ID: "12345678"},
+	})
+	reader, channel := NewReader(source)
+	result := <-channel
+	require.Equal(t, NfcStateError, result.Result)
+	result = <-channel
+	require.Equal(t, NfcStateTagPresent, result.Result)
+	require.Equal(t, 0, reader.Health().Reconnects)
+	reader.Close()
+	for range channel {
+	}
+}
+
+func TestReaderContext(t *testing.T) {
+	source := NewScriptedSource([]ScriptedEvent{
+		ScriptedEvent{Result: NfcStateTagPresent, ID: "12345678"},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	_, channel := NewRecoveringReader(ctx, "test", func() (TagSource, error) {
+		return source, nil
+	}, Options{})
+	result := <-channel
+	require.Equal(t, NfcStateTagPresent, result.Result)
+	cancel()
+	for range channel {
+	}
+	require.True(t, source.Closed())
+}
+
+func TestMerge(t *testing.T) {
+	first, firstChannel := NewRecoveringReader(context.Background(), "first", func() (TagSource, error) {
+		return NewScriptedSource([]ScriptedEvent{
+			ScriptedEvent{Result: NfcStateTagPresent, ID: "12345678"},
+		}), nil
+	}, Options{})
+	second, secondChannel := NewRecoveringReader(context.Background(), "second", func() (TagSource, error) {
+		return NewScriptedSource([]ScriptedEvent{
+			ScriptedEvent{After: 20 * time.Millisecond, Result: NfcStateTagPresent, ID: "ABCDEF"},
+		}), nil
+	}, Options{})
+	channel := Merge(firstChannel, secondChannel)
+	readers := map[string]string{}
+	for len(readers) < 2 {
+		result := <-channel
+		readers[result.Reader] = result.ID
+	}
+	require.Equal(t, map[string]string{"first": "12345678", "second": "ABCDEF"}, readers)
+	first.Close()
+	second.Close()
+	for range channel {
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	present := func(after time.Duration, id string) ScriptedEvent {
+		return ScriptedEvent{After: after, Result: NfcStateTagPresent, ID: id}
+	}
+	absent := func(after time.Duration) ScriptedEvent {
+		return ScriptedEvent{After: after, Result: NfcStateTagNotPresent}
+	}
+	testCases := []struct {
+		name     string
+		debounce DebounceOptions
+		events   []ScriptedEvent
+		expected []string
+	}{
+		{
+			name:     "no debounce reports glitches",
+			events:   []ScriptedEvent{present(0, "A"), absent(20 * time.Millisecond), present(20*time.Millisecond, "A")},
+			expected: []string{"A", "-", "A"},
+		},
+		{
+			name:     "short absence is filtered",
+			debounce: DebounceOptions{Absent: 100 * time.Millisecond},
+			events:   []ScriptedEvent{present(0, "A"), absent(20 * time.Millisecond), present(30*time.Millisecond, "A")},
+			expected: []string{"A"},
+		},
+		{
+			name:     "long absence is reported",
+			debounce: DebounceOptions{Absent: 50 * time.Millisecond},
+			events:   []ScriptedEvent{present(0, "A"), absent(20 * time.Millisecond), present(150*time.Millisecond, "A")},
+			expected: []string{"A", "-", "A"},
+		},
+		{
+			name:     "short reading is filtered",
+			debounce: DebounceOptions{Present: 50 * time.Millisecond},
+			events:   []ScriptedEvent{present(0, "A"), absent(20 * time.Millisecond), present(100*time.Millisecond, "B")},
+			expected: []string{"B"},
+		},
+		{
+			name:     "tag swapped during absence",
+			debounce: DebounceOptions{Absent: 100 * time.Millisecond},
+			events:   []ScriptedEvent{present(0, "A"), absent(50 * time.Millisecond), present(30*time.Millisecond, "B")},
+			expected: []string{"A", "B"},
+		},
+		{
+			name:     "flapping tag is reported once",
+			debounce: DebounceOptions{Present: 30 * time.Millisecond, Absent: 30 * time.Millisecond},
+			events: []ScriptedEvent{
+				present(0, "A"), absent(10 * time.Millisecond), present(10*time.Millisecond, "A"),
+				absent(10 * time.Millisecond), present(10*time.Millisecond, "A"), absent(100 * time.Millisecond),
+			},
+			expected: []string{"A", "-"},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			source := NewScriptedSource(testCase.events)
+			reader, channel := NewRecoveringReader(context.Background(), "test", func() (TagSource, error) {
+				return source, nil
+			}, Options{Debounce: testCase.debounce})
+			done := make(chan []string)
+			go func() {
+				results := []string{}
+				for result := range channel {
+					if result.Result == NfcStateTagPresent {
+						results = append(results, result.ID)
+					} else {
+						results = append(results, "-")
+					}
+				}
+				done <- results
+			}()
+			for !source.Finished() {
+				time.Sleep(5 * time.Millisecond)
+			}
+			time.Sleep(testCase.debounce.Present + testCase.debounce.Absent + 50*time.Millisecond)
+			reader.Close()
+			require.Equal(t, testCase.expected, <-done)
+		})
+	}
+}
+
+func TestLineSource(t *testing.T) {
+	source := NewLineSource(strings.NewReader("12345678\n\nABCDEF\n"))
+	reader, channel := NewReader(source)
+	defer reader.Close()
+	// the lines are read faster than polled, only the last state is seen.
+	result := <-channel
+	require.Equal(t, NfcStateTagPresent, result.Result)
+	require.Equal(t, "ABCDEF", result.ID)
+}
+
+// hidInput returns the input events of a reader typing the ID followed by
+// enter.
+func hidInput(id string) []byte {
+	codes := map[byte]uint16{}
+	for code, char := range hidKeys {
+		codes[char] = code
+	}
+	var input bytes.Buffer
+	typeKey := func(code uint16) {
+		for _, value := range []int32{1, 0} {
+			event := make([]byte, inputEventSize)
+			binary.LittleEndian.PutUint16(event[inputEventSize-8:], evKey)
+			binary.LittleEndian.PutUint16(event[inputEventSize-6:], code)
+			binary.LittleEndian.PutUint32(event[inputEventSize-4:], uint32(value))
+			input.Write(event)
+		}
+	}
+	for idx := 0; idx < len(id); idx++ {
+		typeKey(codes[id[idx]])
+	}
+	typeKey(keyEnter)
+	return input.Bytes()
+}
+
+// newPipeHIDSource returns a HID source reading from a pipe, the returned
+// writer types into the source.
+func newPipeHIDSource(t *testing.T, removalTimeout time.Duration) (*HIDSource, *os.File) {
+	in, out, err := os.Pipe()
+	require.NoError(t, err)
+	source := new(HIDSource)
+	source.device = in
+	source.removalTimeout = removalTimeout
+	go source.readEvents(in)
+	return source, out
+}
+
+func TestHIDSource(t *testing.T) {
+	source, out := newPipeHIDSource(t, 300*time.Millisecond)
+	defer source.Close()
+	_, err := out.Write(hidInput("0123"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return source.Poll().ID == "0123"
+	}, time.Second, 10*time.Millisecond)
+	// the tag is removed after the timeout.
+	time.Sleep(300 * time.Millisecond)
+	result := source.Poll()
+	require.Equal(t, NfcStateTagNotPresent, result.Result)
+	// the end of the input, e.g. unplugging the reader, is reported until
+	// the source is closed.
+	out.Close()
+	require.Eventually(t, func() bool {
+		return source.Poll().Result == NfcStateError
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, NfcStateError, source.Poll().Result)
+}
+
+func TestUnpluggedSourceReopened(t *testing.T) {
+	options := Options{Recovery: RecoveryOptions{MaxFailures: 2, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond}}
+	opened := 0
+	reader, channel := NewRecoveringReader(context.Background(), "test", func() (TagSource, error) {
+		source, out := newPipeHIDSource(t, 0)
+		opened++
+		if opened == 1 {
+			// the first reader is unplugged.
+			out.Close()
+		} else {
+			out.Write(hidInput("0123"))
+		}
+		return source, nil
+	}, options)
+	defer reader.Close()
+	for {
+		result := <-channel
+		if result.Result == NfcStateTagPresent {
+			require.Equal(t, "0123", result.ID)
+			break
+		}
+		require.Equal(t, NfcStateError, result.Result)
+	}
+	require.Equal(t, 1, reader.Health().Reconnects)
+}
+
+func TestSerialReadings(t *testing.T) {
+	testCases := []struct {
+		reading string
+		id      string
+	}{
+		{"0123456789", "0123456789"},
+		// RDM6300 frame with valid checksum.
+		{"\x0262E3086CED08", "62E3086CED"},
+		// RDM6300 frame with invalid checksum.
+		{"\x0262E3086CED09", ""},
+		{"\x02short", ""},
+		// lines of twelve hex digits are no frames.
+		{"62E3086CED09", "62E3086CED09"},
+		{" 4711 ", "4711"},
+	}
+	for _, testCase := range testCases {
+		require.Equal(t, testCase.id, parseSerialReading(testCase.reading), testCase.reading)
+	}
+	var readings []string
+	data := []byte("\x0262E3086CED08\x03\x0262E3086CED08\x03line\r\nline\x0262E3086CED08\x03")
+	for len(data) > 0 {
+		advance, token, err := scanSerialReadings(data, true)
+		require.NoError(t, err)
+		if len(token) > 0 {
+			readings = append(readings, string(token))
+		}
+		data = data[advance:]
+	}
+	require.Equal(t, []string{"\x0262E3086CED08", "\x0262E3086CED08", "line", "line", "\x0262E3086CED08"}, readings)
+}
+
+func TestRemovalTimeout(t *testing.T) {
+	source := new(readingSource)
+	source.removalTimeout = 300 * time.Millisecond
+	source.report("4711")
+	require.Equal(t, NfcStateTagPresent, source.Poll().Result)
+	// repeated readings keep the tag present.
+	source.report("4711")
+	require.Equal(t, NfcStateTagPresent, source.Poll().Result)
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, NfcStateTagNotPresent, source.Poll().Result)
+	// without timeout, the tag stays until another tag is read.
+	source.removalTimeout = 0
+	source.report("4711")
+	time.Sleep(150 * time.Millisecond)
+	require.Equal(t, "4711", source.Poll().ID)
+	source.report("4712")
+	require.Equal(t, "4712", source.Poll().ID)
+}
+
+func TestReadBookID(t *testing.T) {
+	uri := append([]byte{0x00}, BookURI("4711", 3)...)
+	record := append([]byte{0xd1, 0x01, byte(len(uri)), 'U'}, uri...)
+	id, track, err := readBookID(ndeftest.NewTag(append([]byte{0x03, byte(len(record))}, append(record, 0xfe)...)))
+	require.NoError(t, err)
+	require.Equal(t, "4711", id)
+	require.Equal(t, 3, track)
+	// text records work as well.
+	text := append([]byte{0x02, 'e', 'n'}, BookURIPrefix+"4712"...)
+	record = append([]byte{0xd1, 0x01, byte(len(text)), 'T'}, text...)
+	id, track, err = readBookID(ndeftest.NewTag(append([]byte{0x03, byte(len(record))}, append(record, 0xfe)...)))
+	require.NoError(t, err)
+	require.Equal(t, "4712", id)
+	require.Equal(t, 0, track)
+	// other records and empty tags carry no ID.
+	uri = append([]byte{0x04}, "example.com"...)
+	record = append([]byte{0xd1, 0x01, byte(len(uri)), 'U'}, uri...)
+	id, _, err = readBookID(ndeftest.NewTag(append([]byte{0x03, byte(len(record))}, append(record, 0xfe)...)))
+	require.NoError(t, err)
+	require.Equal(t, "", id)
+	id, _, err = readBookID(ndeftest.NewTag([]byte{0x03, 0x00, 0xfe}))
+	require.NoError(t, err)
+	require.Equal(t, "", id)
+	// read errors are reported.
+	_, _, err = readBookID(&ndeftest.Tag{})
+	require.Error(t, err)
+}
+
+// flakyTag is a Type 2 tag whose first reads fail.
+type flakyTag struct {
+	*ndeftest.Tag
+	failures int
+}
+
+func (t *flakyTag) ReadPages(page byte) ([]byte, error) {
+	if t.failures > 0 {
+		t.failures--
+		return nil, errors.New("read failed")
+	}
+	return t.Tag.ReadPages(page)
+}
+
+func TestTagCache(t *testing.T) {
+	uri := append([]byte{0x00}, BookURI("4711", 3)...)
+	record := append([]byte{0xd1, 0x01, byte(len(uri)), 'U'}, uri...)
+	memory := ndeftest.NewTag(append([]byte{0x03, byte(len(record))}, append(record, 0xfe)...))
+	// the tag is not reported until the audiobook ID is read.
+	cache := new(tagCache)
+	tag := &flakyTag{Tag: memory, failures: 1}
+	require.Equal(t, NfcStateTagNotPresent, cache.resolve("04A1B2C3", tag).Result)
+	result := cache.resolve("04A1B2C3", tag)
+	require.Equal(t, NfcStateTagPresent, result.Result)
+	require.Equal(t, "4711", result.ID)
+	require.Equal(t, 3, result.Track)
+	// the result is cached while the tag is present.
+	tag.failures = 1
+	require.Equal(t, "4711", cache.resolve("04A1B2C3", tag).ID)
+	// tags failing to read are identified by their UID eventually.
+	cache.clear()
+	tag.failures = maxBookIDReadFailures
+	for idx := 1; idx < maxBookIDReadFailures; idx++ {
+		require.Equal(t, NfcStateTagNotPresent, cache.resolve("04A1B2C3", tag).Result)
+	}
+	require.Equal(t, "04A1B2C3", cache.resolve("04A1B2C3", tag).ID)
+	require.Equal(t, "04A1B2C3", cache.resolve("04A1B2C3", tag).ID)
+	// tags other than Type 2 tags are identified by their UID.
+	require.Equal(t, "04A1B2C4", cache.resolve("04A1B2C4", nil).ID)
+}
+
+func TestBookURI(t *testing.T) {
+	require.Equal(t, "piena://book/4711", BookURI("4711", 0))
+	require.Equal(t, "piena://book/0x04a1b2c3?track=2", BookURI("0x04a1b2c3", 2))
+	id, track, err := parseBookURI("0x04a1b2c3?track=2")
+	require.NoError(t, err)
+	require.Equal(t, "0x04a1b2c3", id)
+	require.Equal(t, 2, track)
+	_, _, err = parseBookURI("4711?track=0")
+	require.Error(t, err)
+	_, _, err = parseBookURI("")
+	require.Error(t, err)
 }
@@ -0,0 +1,67 @@
+package reader
+
+import (
+	"sync"
+	"time"
+)
+
+// readingPollInterval is the interval sources fed by readings are polled
+// with.
+const readingPollInterval = 50 * time.Millisecond
+
+// readingSource keeps the state of readers that only report readings of a
+// tag, but not its removal. The tag is considered removed if it was not
+// read again within the removal timeout. Without timeout, the tag is
+// considered present until another tag is read.
+type readingSource struct {
+	mutex          sync.Mutex
+	id             string
+	lastSeen       time.Time
+	removalTimeout time.Duration
+	err            error
+	closed         bool
+}
+
+// report records a reading of the tag with the given ID.
+func (s *readingSource) report(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.id = id
+	s.lastSeen = time.Now()
+}
+
+// fail records the error reading stopped with, e.g. because the device was
+// unplugged. Unless the source was closed, the error is returned by every
+// following poll, so the reader reopens the source.
+func (s *readingSource) fail(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.closed {
+		s.err = err
+	}
+}
+
+// Poll returns the current tag, removing it if the removal timeout passed.
+func (s *readingSource) Poll() *NfcReadResult {
+	time.Sleep(readingPollInterval)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err != nil {
+		return &NfcReadResult{Result: NfcStateError, Err: s.err}
+	}
+	if s.id != "" && s.removalTimeout > 0 && time.Since(s.lastSeen) > s.removalTimeout {
+		s.id = ""
+	}
+	if s.id == "" {
+		return &NfcReadResult{Result: NfcStateTagNotPresent}
+	}
+	return &NfcReadResult{Result: NfcStateTagPresent, ID: s.id}
+}
+
+// markClosed marks the source as closed, so read errors caused by closing
+// are not reported.
+func (s *readingSource) markClosed() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+}
@@ -0,0 +1,92 @@
+package reader
+
+import (
+	"sync"
+	"time"
+)
+
+// scriptedPollInterval is the interval the scripted source is polled with.
+const scriptedPollInterval = 5 * time.Millisecond
+
+// ScriptedEvent is a change of the tag state of a scripted source.
+type ScriptedEvent struct {
+	// After is the time after the previous event the event happens.
+	After time.Duration
+	// Result is the new state, NfcStateTagPresent or NfcStateTagNotPresent.
+	Result int
+	// ID is the ID of the present tag.
+	ID string
+	// BookID is true if ID is an audiobook ID stored on the tag.
+	BookID bool
+	// Err is returned once instead of changing the state if set.
+	Err error
+}
+
+// ScriptedSource replays a sequence of events, for testing. After the last
+// event, the last state is kept.
+type ScriptedSource struct {
+	mutex   sync.Mutex
+	events  []ScriptedEvent
+	times   []time.Duration
+	start   time.Time
+	next    int
+	current NfcReadResult
+	closed  bool
+}
+
+// NewScriptedSource returns a source replaying the given events. The timing
+// starts with the first poll.
+func NewScriptedSource(events []ScriptedEvent) *ScriptedSource {
+	s := new(ScriptedSource)
+	s.events = events
+	var at time.Duration
+	for _, event := range events {
+		at += event.After
+		s.times = append(s.times, at)
+	}
+	s.current = NfcReadResult{Result: NfcStateTagNotPresent}
+	return s
+}
+
+// Poll returns the state of the script at the current time.
+func (s *ScriptedSource) Poll() *NfcReadResult {
+	time.Sleep(scriptedPollInterval)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.start.IsZero() {
+		s.start = time.Now()
+	}
+	elapsed := time.Since(s.start)
+	for s.next < len(s.events) && s.times[s.next] <= elapsed {
+		event := s.events[s.next]
+		s.next++
+		if event.Err != nil {
+			return &NfcReadResult{Result: NfcStateError, Err: event.Err}
+		}
+		s.current = NfcReadResult{Result: event.Result, ID: event.ID, BookID: event.BookID}
+	}
+	result := s.current
+	return &result
+}
+
+// Finished returns true if all events were replayed.
+func (s *ScriptedSource) Finished() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.next == len(s.events)
+}
+
+// Closed returns true if the source was closed.
+func (s *ScriptedSource) Closed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+// Close marks the source as closed.
+func (s *ScriptedSource) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	return nil
+}
@@ -0,0 +1,119 @@
+package reader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// stx and etx frame the readings of RDM6300 style readers.
+	stx = 0x02
+	etx = 0x03
+)
+
+// SerialSource reads tag IDs from readers connected to a serial port. Lines
+// of text and RDM6300 style frames (STX, ten hex digits ID, two hex digits
+// checksum, ETX) are supported.
+type SerialSource struct {
+	readingSource
+	port *os.File
+}
+
+// NewSerialSource opens the serial port at the given path with the given
+// baud rate, e.g. /dev/ttyUSB0 with 9600 baud. See readingSource for the
+// removal timeout. Readers repeating the ID while the tag is present need
+// a timeout slightly longer than their repeat interval.
+func NewSerialSource(path string, baudRate int, removalTimeout time.Duration) (*SerialSource, error) {
+	port, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = configureSerialPort(port, baudRate)
+	if err != nil {
+		port.Close()
+		return nil, err
+	}
+	log.Printf("[reader] opened serial reader device %s\n", path)
+	s := new(SerialSource)
+	s.port = port
+	s.removalTimeout = removalTimeout
+	go s.readLines(port)
+	return s, nil
+}
+
+func (s *SerialSource) readLines(port *os.File) {
+	scanner := bufio.NewScanner(port)
+	scanner.Split(scanSerialReadings)
+	for scanner.Scan() {
+		if id := parseSerialReading(scanner.Text()); id != "" {
+			s.report(id)
+		}
+	}
+	err := scanner.Err()
+	if err == nil {
+		// the end of the input, e.g. the device was unplugged.
+		err = io.EOF
+	}
+	s.fail(err)
+}
+
+// scanSerialReadings splits the input at line ends and frame markers. The
+// STX marker is kept at the start of framed readings, so they are told apart
+// from lines.
+func scanSerialReadings(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) > 0 && data[0] == stx {
+		if idx := bytes.IndexByte(data, etx); idx >= 0 {
+			return idx + 1, data[:idx], nil
+		}
+		if atEOF {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+	if idx := bytes.IndexAny(data, "\r\n\x02\x03"); idx >= 0 {
+		if data[idx] == stx {
+			// a frame starts, it is the next reading.
+			return idx, data[:idx], nil
+		}
+		return idx + 1, data[:idx], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// parseSerialReading returns the ID of a reading. RDM6300 frames are
+// checked against their checksum, lines are used as they are.
+func parseSerialReading(reading string) string {
+	if len(reading) == 0 || reading[0] != stx {
+		return strings.TrimSpace(reading)
+	}
+	reading = strings.TrimSpace(reading[1:])
+	frame, err := hex.DecodeString(reading)
+	if err != nil || len(frame) != 6 {
+		log.Printf("[reader] dropping invalid serial frame: %q\n", reading)
+		return ""
+	}
+	checksum := byte(0)
+	for _, b := range frame[:5] {
+		checksum ^= b
+	}
+	if checksum != frame[5] {
+		log.Printf("[reader] dropping serial reading with invalid checksum: %s\n", reading)
+		return ""
+	}
+	return reading[:10]
+}
+
+// Close closes the serial port.
+func (s *SerialSource) Close() error {
+	s.markClosed()
+	return s.port.Close()
+}
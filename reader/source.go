@@ -0,0 +1,10 @@
+package reader
+
+// TagSource is a source of tag readings, like an NFC reader device.
+type TagSource interface {
+	// Poll returns the current state of the source. It may block for a
+	// while, but returns regularly so the reader can be terminated.
+	Poll() *NfcReadResult
+	// Close releases the source.
+	Close() error
+}
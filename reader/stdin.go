@@ -0,0 +1,62 @@
+package reader
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// linePollInterval is the interval the line source is polled with.
+const linePollInterval = 100 * time.Millisecond
+
+// LineSource reads tag IDs from lines of text, e.g. typed on stdin on
+// development machines without reader. A line with an ID places the tag on
+// the reader, an empty line or "-" removes it.
+type LineSource struct {
+	mutex   sync.Mutex
+	current NfcReadResult
+}
+
+// NewLineSource returns a source reading lines from the given reader.
+func NewLineSource(in io.Reader) *LineSource {
+	s := new(LineSource)
+	s.current = NfcReadResult{Result: NfcStateTagNotPresent}
+	go s.readLines(in)
+	return s
+}
+
+func (s *LineSource) readLines(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		s.mutex.Lock()
+		if line == "" || line == "-" {
+			log.Println("[reader] removing tag from line input")
+			s.current = NfcReadResult{Result: NfcStateTagNotPresent}
+		} else {
+			log.Printf("[reader] placing tag %s from line input\n", line)
+			s.current = NfcReadResult{Result: NfcStateTagPresent, ID: line}
+		}
+		s.mutex.Unlock()
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("[reader] error reading line input: %s\n", err.Error())
+	}
+}
+
+// Poll returns the state set by the last line.
+func (s *LineSource) Poll() *NfcReadResult {
+	time.Sleep(linePollInterval)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := s.current
+	return &result
+}
+
+// Close does nothing, the input is owned by the caller.
+func (s *LineSource) Close() error {
+	return nil
+}
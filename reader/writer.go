@@ -0,0 +1,81 @@
+//go:build libnfc
+// +build libnfc
+
+package reader
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/michaelkleinhenz/piena/ndef"
+	"github.com/michaelkleinhenz/piena/nfc"
+)
+
+// tagWaitInterval is the interval a tag to be written is polled for.
+const tagWaitInterval = 200 * time.Millisecond
+
+// WriteTag waits for an NTAG21x or MIFARE Ultralight tag on the libnfc
+// device with the given connection string and writes the audiobook ID as
+// NDEF record. The record is verified by reading it back. Returns the UID
+// of the written tag.
+func WriteTag(connection string, options WriteOptions) (string, error) {
+	if options.ID == "" {
+		return "", errors.New("no audiobook id given")
+	}
+	source, err := NewLibnfcSource(connection)
+	if err != nil {
+		return "", err
+	}
+	defer source.Close()
+	uid, err := source.waitForType2Tag(options.Timeout)
+	if err != nil {
+		return "", err
+	}
+	uri := BookURI(options.ID, options.Track)
+	log.Printf("[reader] writing %s to tag %s\n", uri, uid)
+	message := ndef.EncodeMessage([]ndef.Record{ndef.NewURIRecord(uri)})
+	err = ndef.WriteType2Message(source.device, message)
+	if err != nil {
+		return uid, err
+	}
+	id, track, err := readBookID(source.device)
+	if err != nil {
+		return uid, fmt.Errorf("verifying tag failed: %v", err)
+	}
+	if id != options.ID || track != options.Track {
+		return uid, fmt.Errorf("verifying tag failed: read back id %s and track %d", id, track)
+	}
+	log.Printf("[reader] verified tag %s\n", uid)
+	if options.Lock {
+		log.Printf("[reader] locking tag %s\n", uid)
+		err = ndef.LockType2(source.device)
+		if err != nil {
+			return uid, fmt.Errorf("locking tag failed: %v", err)
+		}
+	}
+	return uid, nil
+}
+
+// waitForType2Tag polls until a Type 2 tag is selected and returns its UID.
+func (s *LibnfcSource) waitForType2Tag(timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		target, err := s.device.InitiatorSelectPassiveTarget(nfc.Modulation{Type: nfc.ISO14443a, BaudRate: nfc.Nbr106}, nil)
+		if err != nil {
+			return "", err
+		}
+		if target != nil {
+			card, ok := target.(*nfc.ISO14443aTarget)
+			if !ok || card.Sak != type2SAK {
+				return "", errors.New("tag is not an NTAG21x or MIFARE Ultralight tag")
+			}
+			return nfc.TargetID(target)
+		}
+		if time.Now().After(deadline) {
+			return "", errors.New("no tag placed on reader")
+		}
+		time.Sleep(tagWaitInterval)
+	}
+}
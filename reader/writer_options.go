@@ -0,0 +1,15 @@
+package reader
+
+import "time"
+
+// WriteOptions describe what is written to a tag.
+type WriteOptions struct {
+	// ID is the audiobook ID.
+	ID string
+	// Track is the optional start track, 0 if none.
+	Track int
+	// Lock makes the tag permanently read-only after writing.
+	Lock bool
+	// Timeout is the time to wait for a tag to be placed on the reader.
+	Timeout time.Duration
+}
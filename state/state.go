@@ -6,6 +6,8 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+
+	"github.com/michaelkleinhenz/piena/base"
 )
 
 // AudiobookState stores the current state of an audiobook
@@ -42,7 +44,7 @@ func NewState(filepath string) (*State, error) {
 // Exists checks if a state exists.
 func (s *State) Exists(audiobookID string) bool {
 	for idx := range s.states {
-		if s.states[idx].ID == audiobookID {
+		if base.TagIDsMatch(s.states[idx].ID, audiobookID) {
 			return true
 		}
 	}
@@ -52,7 +54,7 @@ func (s *State) Exists(audiobookID string) bool {
 // SetOrd stores a state.
 func (s *State) SetOrd(audiobookID string, ord int) error {
 	for idx := range s.states {
-		if s.states[idx].ID == audiobookID {
+		if base.TagIDsMatch(s.states[idx].ID, audiobookID) {
 			log.Printf("[state] updating ord %d for audiobook %s", ord, audiobookID)
 			s.states[idx].CurrentOrd = ord
 			return s.store()
@@ -65,7 +67,7 @@ func (s *State) SetOrd(audiobookID string, ord int) error {
 func (s *State) Set(audiobookID string, artist string, title string, ord int) error {
 	log.Printf("[state] storing ord %d for audiobook %s", ord, audiobookID)
 	for idx := range s.states {
-		if s.states[idx].ID == audiobookID {
+		if base.TagIDsMatch(s.states[idx].ID, audiobookID) {
 			s.states[idx].CurrentOrd = ord
 			return s.store()
 		}
@@ -82,7 +84,7 @@ func (s *State) Set(audiobookID string, artist string, title string, ord int) er
 // Remove removes a state.
 func (s *State) Remove(audiobookID string) error {
 	for idx := range s.states {
-		if s.states[idx].ID == audiobookID {
+		if base.TagIDsMatch(s.states[idx].ID, audiobookID) {
 			log.Printf("[state] removing state for audiobook %s", audiobookID)
 			s.states = append(s.states[:idx], s.states[idx+1:]...)
 			return s.store()
@@ -95,7 +97,7 @@ func (s *State) Remove(audiobookID string) error {
 // Get retrieves a state.
 func (s *State) Get(audiobookID string) (int, error) {
 	for _, entry := range s.states {
-		if entry.ID == audiobookID {
+		if base.TagIDsMatch(entry.ID, audiobookID) {
 			return entry.CurrentOrd, nil
 		}
 	}
@@ -105,7 +107,7 @@ func (s *State) Get(audiobookID string) (int, error) {
 // GetArtistAndTitle retrieves artist and title from the ID.
 func (s *State) GetArtistAndTitle(audiobookID string) (string, string, error) {
 	for _, entry := range s.states {
-		if entry.ID == audiobookID {
+		if base.TagIDsMatch(entry.ID, audiobookID) {
 			return entry.Artist, entry.Title, nil
 		}
 	}
@@ -43,6 +43,12 @@ func TestStore(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "aa", artist)	
 	assert.Equal(t, "ta", title)	
+	// entry stored with padded uid of previous versions
+	assert.NoError(t, stateStore.Set("0x04a1b2c3000000000000", "a04", "t04", 7))
+	assert.True(t, stateStore.Exists("04:A1:B2:C3"))
+	result, err = stateStore.Get("04A1B2C3")
+	assert.NoError(t, err)
+	assert.Equal(t, 7, result)
 	// new entry
 	assert.NoError(t, stateStore.Set("999", "a999", "t999", 23))
 	result, err = stateStore.Get("999")
@@ -0,0 +1,264 @@
+package uploader
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/michaelkleinhenz/piena/base"
+	"gopkg.in/yaml.v2"
+)
+
+// idFilename is the name of the file containing the audiobook ID in a
+// folder tree used for batch uploads.
+const idFilename = "id"
+
+// BatchEntry describes a single audiobook of a batch upload.
+type BatchEntry struct {
+	Dir              string `yaml:"dir"`
+	Artist           string `yaml:"artist"`
+	Title            string `yaml:"title"`
+	ID               string `yaml:"id"`
+	AudiobookDetails `yaml:",inline"`
+}
+
+// BatchResult is the outcome of uploading a single batch entry.
+type BatchResult struct {
+	Entry BatchEntry
+	Err   error
+}
+
+// BatchReport lists the outcome of all entries of a batch upload.
+type BatchReport struct {
+	Results []BatchResult
+}
+
+// Failed returns the number of entries that failed to upload.
+func (r *BatchReport) Failed() int {
+	failed := 0
+	for _, result := range r.Results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// Write writes the report as CSV to the given writer.
+func (r *BatchReport) Write(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "artist", "title", "dir", "status", "error"})
+	for _, result := range r.Results {
+		status, message := "ok", ""
+		if result.Err != nil {
+			status, message = "failed", result.Err.Error()
+		}
+		writer.Write([]string{result.Entry.ID, result.Entry.Artist, result.Entry.Title, result.Entry.Dir, status, message})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// ReadManifest reads the batch entries from a CSV or YAML manifest. CSV
+// manifests need a header row naming the dir, artist, title and id columns
+// and optionally the description, series, seriesIndex, ageRating and
+// language columns. Relative directories are resolved against the directory
+// of the manifest. If artist or title are empty, they are inferred from an
+// Artist/Title layout of the directory.
+func ReadManifest(path string) ([]BatchEntry, error) {
+	manifestBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []BatchEntry
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		entries, err = parseCSVManifest(manifestBytes)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(manifestBytes, &entries)
+	default:
+		err = fmt.Errorf("unsupported manifest format: %s", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for idx := range entries {
+		if !filepath.IsAbs(entries[idx].Dir) {
+			entries[idx].Dir = filepath.Join(filepath.Dir(path), entries[idx].Dir)
+		}
+		inferArtistAndTitle(&entries[idx])
+	}
+	log.Printf("[uploader] read %d entries from manifest %s", len(entries), path)
+	return entries, nil
+}
+
+func parseCSVManifest(manifestBytes []byte) ([]BatchEntry, error) {
+	records, err := csv.NewReader(strings.NewReader(string(manifestBytes))).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("manifest is empty")
+	}
+	columns := map[string]int{}
+	for idx, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = idx
+	}
+	if _, ok := columns["dir"]; !ok {
+		return nil, errors.New("manifest has no dir column")
+	}
+	field := func(record []string, name string) string {
+		if idx, ok := columns[name]; ok && idx < len(record) {
+			return strings.TrimSpace(record[idx])
+		}
+		return ""
+	}
+	number := func(record []string, name string) (int, error) {
+		value := field(record, name)
+		if value == "" {
+			return 0, nil
+		}
+		return strconv.Atoi(value)
+	}
+	entries := []BatchEntry{}
+	for line, record := range records[1:] {
+		entry := BatchEntry{
+			Dir:    field(record, "dir"),
+			Artist: field(record, "artist"),
+			Title:  field(record, "title"),
+			ID:     field(record, "id"),
+		}
+		entry.Description = field(record, "description")
+		entry.Series = field(record, "series")
+		entry.Language = field(record, "language")
+		if entry.SeriesIndex, err = number(record, "seriesindex"); err != nil {
+			return nil, fmt.Errorf("invalid seriesIndex in line %d: %v", line+2, err)
+		}
+		if entry.AgeRating, err = number(record, "agerating"); err != nil {
+			return nil, fmt.Errorf("invalid ageRating in line %d: %v", line+2, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// inferArtistAndTitle fills in missing artist and title from an
+// Artist/Title layout of the entry directory.
+func inferArtistAndTitle(entry *BatchEntry) {
+	dir := filepath.Clean(entry.Dir)
+	if entry.Title == "" {
+		entry.Title = filepath.Base(dir)
+	}
+	if entry.Artist == "" {
+		entry.Artist = filepath.Base(filepath.Dir(dir))
+	}
+}
+
+// ScanFolderTree creates batch entries from a folder tree with the layout
+// root/Artist/Title. The ID of each audiobook is read from a file named
+// "id" in the audiobook folder.
+func ScanFolderTree(root string) ([]BatchEntry, error) {
+	artists, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	entries := []BatchEntry{}
+	for _, artist := range artists {
+		if !artist.IsDir() {
+			continue
+		}
+		titles, err := ioutil.ReadDir(filepath.Join(root, artist.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, title := range titles {
+			if !title.IsDir() {
+				continue
+			}
+			entry := BatchEntry{
+				Dir:    filepath.Join(root, artist.Name(), title.Name()),
+				Artist: artist.Name(),
+				Title:  title.Name(),
+			}
+			idBytes, err := ioutil.ReadFile(filepath.Join(entry.Dir, idFilename))
+			if err == nil {
+				entry.ID = strings.TrimSpace(string(idBytes))
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+	log.Printf("[uploader] found %d audiobooks in %s", len(entries), root)
+	return entries, nil
+}
+
+// UploadBatch uploads all given entries to the bucket and adds the
+// successfully uploaded audiobooks to the directory in a single update.
+// Failing entries do not stop the batch, their errors are listed in the
+// returned report. An error is only returned if the directory could not be
+// updated.
+func (u *Uploader) UploadBatch(entries []BatchEntry, bucket string) (*BatchReport, error) {
+	report := new(BatchReport)
+	audiobooks := []base.Audiobook{}
+	uploaded := []int{}
+	for _, entry := range entries {
+		log.Printf("[uploader] batch uploading %s %s from %s", entry.Artist, entry.Title, entry.Dir)
+		audiobook, err := u.uploadBatchEntry(entry, bucket)
+		if err != nil {
+			log.Printf("[uploader] batch upload of %s %s failed: %s", entry.Artist, entry.Title, err.Error())
+		} else {
+			audiobooks = append(audiobooks, *audiobook)
+			uploaded = append(uploaded, len(report.Results))
+		}
+		report.Results = append(report.Results, BatchResult{Entry: entry, Err: err})
+	}
+	if len(audiobooks) == 0 {
+		return report, nil
+	}
+	log.Printf("[uploader] adding %d audiobooks to directory", len(audiobooks))
+	err := u.updateDirectory(bucket, func(directory *base.AudiobookDirectory) {
+		for _, audiobook := range audiobooks {
+			addOrReplaceAudiobook(directory, audiobook)
+		}
+	})
+	if err != nil {
+		for _, idx := range uploaded {
+			report.Results[idx].Err = err
+		}
+		return report, err
+	}
+	return report, nil
+}
+
+func (u *Uploader) uploadBatchEntry(entry BatchEntry, bucket string) (*base.Audiobook, error) {
+	if entry.Dir == "" || entry.Artist == "" || entry.Title == "" || entry.ID == "" {
+		return nil, errors.New("not all required fields given (dir, artist, title, id)")
+	}
+	tracks, err := u.TagRenameFiles(entry.Dir, entry.Artist, entry.Title)
+	if err != nil {
+		return nil, err
+	}
+	details := entry.AudiobookDetails
+	details.CoverImage, err = u.UploadCoverFile(entry.Artist, entry.Title, bucket)
+	if err != nil {
+		return nil, err
+	}
+	packageFile, err := u.PackageFiles(tracks, entry.Artist, entry.Title)
+	if err != nil {
+		return nil, err
+	}
+	err = u.UploadPackageFile(packageFile, bucket)
+	if err != nil {
+		return nil, err
+	}
+	audiobook := newAudiobook(packageFile, tracks, entry.ID, entry.Artist, entry.Title, details)
+	return &audiobook, nil
+}
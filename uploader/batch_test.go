@@ -0,0 +1,111 @@
+package uploader
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadManifest(t *testing.T) {
+	path, err := ioutil.TempDir("", "piena-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(path)
+	t.Run("reading csv manifest", func(t *testing.T) {
+		manifest := "dir,artist,title,id,series,seriesIndex,ageRating,language\n" +
+			"books/a,Artist A,Title A,111,Series A,1,6,de\n" +
+			"Artist B/Title B,,,222,,,,\n"
+		assert.NoError(t, ioutil.WriteFile(path + "/manifest.csv", []byte(manifest), 0644))
+		entries, err := ReadManifest(path + "/manifest.csv")
+		assert.NoError(t, err)
+		assert.Equal(t, []BatchEntry{
+			{Dir: path + "/books/a", Artist: "Artist A", Title: "Title A", ID: "111",
+				AudiobookDetails: AudiobookDetails{Series: "Series A", SeriesIndex: 1, AgeRating: 6, Language: "de"}},
+			{Dir: path + "/Artist B/Title B", Artist: "Artist B", Title: "Title B", ID: "222"},
+		}, entries)
+	})
+	t.Run("reading yaml manifest", func(t *testing.T) {
+		manifest := "- dir: /books/a\n" +
+			"  artist: Artist A\n" +
+			"  title: Title A\n" +
+			"  id: \"111\"\n" +
+			"- dir: Artist B/Title B\n" +
+			"  id: \"222\"\n" +
+			"  description: A book\n" +
+			"  series: Series B\n" +
+			"  seriesIndex: 2\n"
+		assert.NoError(t, ioutil.WriteFile(path + "/manifest.yaml", []byte(manifest), 0644))
+		entries, err := ReadManifest(path + "/manifest.yaml")
+		assert.NoError(t, err)
+		assert.Equal(t, []BatchEntry{
+			{Dir: "/books/a", Artist: "Artist A", Title: "Title A", ID: "111"},
+			{Dir: path + "/Artist B/Title B", Artist: "Artist B", Title: "Title B", ID: "222",
+				AudiobookDetails: AudiobookDetails{Description: "A book", Series: "Series B", SeriesIndex: 2}},
+		}, entries)
+	})
+	t.Run("rejecting invalid numbers", func(t *testing.T) {
+		manifest := "dir,id,seriesIndex\nbooks/a,111,first\n"
+		assert.NoError(t, ioutil.WriteFile(path + "/invalid.csv", []byte(manifest), 0644))
+		_, err := ReadManifest(path + "/invalid.csv")
+		assert.Error(t, err)
+	})
+	t.Run("rejecting unknown format", func(t *testing.T) {
+		assert.NoError(t, ioutil.WriteFile(path + "/manifest.txt", []byte(""), 0644))
+		_, err := ReadManifest(path + "/manifest.txt")
+		assert.Error(t, err)
+	})
+}
+
+func TestUploadBatch(t *testing.T) {
+	bucket := newFakeBucket()
+	ts := httptest.NewServer(bucket)
+	defer ts.Close()
+	uploader, err := NewUploader()
+	assert.NoError(t, err)
+	uploader.session = newFakeSession(t, ts.URL)
+	// create folder tree with two books and one book without id
+	path, err := ioutil.TempDir("", "piena-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(path)
+	for _, book := range []struct{ dir, id string }{
+		{"Artist A/Title A", "111"},
+		{"Artist A/Title B", "222"},
+		{"Artist B/Title C", ""},
+	} {
+		dir := filepath.Join(path, book.dir)
+		assert.NoError(t, os.MkdirAll(dir, 0755))
+		_, err = createSourceMP3Dir(dir)
+		assert.NoError(t, err)
+		if book.id != "" {
+			assert.NoError(t, ioutil.WriteFile(dir + "/" + idFilename, []byte(book.id + "\n"), 0644))
+		}
+	}
+	entries, err := ScanFolderTree(path)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	// upload batch
+	report, err := uploader.UploadBatch(entries, "tiena-files")
+	assert.NoError(t, err)
+	assert.Len(t, report.Results, 3)
+	assert.Equal(t, 1, report.Failed())
+	assert.Error(t, report.Results[2].Err)
+	// check uploaded files and directory
+	assert.Contains(t, bucket.objects, "/tiena-files/Artist A - Title A.zip")
+	assert.Contains(t, bucket.objects, "/tiena-files/Artist A - Title B.zip")
+	assert.Equal(t, 1, bucket.version)
+	directory := bucket.directory(t)
+	assert.Len(t, directory.Books, 2)
+	assert.Equal(t, "111", directory.Books[0].ID)
+	assert.Equal(t, "Title A", directory.Books[0].Title)
+	assert.Equal(t, "222", directory.Books[1].ID)
+	assert.Len(t, directory.Books[1].Tracks, numTracks)
+	// check report
+	buf := new(bytes.Buffer)
+	assert.NoError(t, report.Write(buf))
+	assert.Contains(t, buf.String(), "111,Artist A,Title A")
+	assert.Contains(t, buf.String(), "failed")
+}
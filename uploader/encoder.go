@@ -0,0 +1,114 @@
+package uploader
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// EncoderOptions configures the external encoder. The encoder is used to
+// transcode the source files to a target codec and to tag source files
+// that are not MP3 files. The encoder must be ffmpeg compatible.
+type EncoderOptions struct {
+	// Path is the encoder executable.
+	Path string
+	// Codec is the target codec (mp3, aac, opus, vorbis or flac). If empty,
+	// the source files keep their codec.
+	Codec string
+	// Bitrate is the target bitrate, e.g. "96k". If empty, the encoder
+	// default is used.
+	Bitrate string
+}
+
+// targetCodec describes the encoder library and file extension of a
+// target codec.
+type targetCodec struct {
+	library   string
+	extension string
+}
+
+var targetCodecs = map[string]targetCodec{
+	"mp3":    {library: "libmp3lame", extension: ".mp3"},
+	"aac":    {library: "aac", extension: ".m4a"},
+	"opus":   {library: "libopus", extension: ".opus"},
+	"vorbis": {library: "libvorbis", extension: ".ogg"},
+	"flac":   {library: "flac", extension: ".flac"},
+}
+
+// audioExtensions are the file extensions accepted as source files.
+var audioExtensions = map[string]bool{
+	".mp3":  true,
+	".flac": true,
+	".m4a":  true,
+	".m4b":  true,
+	".mp4":  true,
+	".aac":  true,
+	".ogg":  true,
+	".oga":  true,
+	".opus": true,
+	".wav":  true,
+}
+
+// isAudioFile checks if the given filename has a supported audio extension.
+func isAudioFile(filename string) bool {
+	return audioExtensions[strings.ToLower(filepath.Ext(filename))]
+}
+
+// SetEncoderOptions configures the external encoder.
+func (u *Uploader) SetEncoderOptions(options EncoderOptions) error {
+	if options.Codec != "" {
+		if _, ok := targetCodecs[options.Codec]; !ok {
+			return fmt.Errorf("unsupported target codec: %s", options.Codec)
+		}
+	}
+	if options.Path == "" {
+		options.Path = defaultEncoder
+	}
+	u.encoder = options
+	return nil
+}
+
+// targetExtension returns the file extension of the packaged file for the
+// given source file.
+func (u *Uploader) targetExtension(srcFile string) string {
+	if codec, ok := targetCodecs[u.encoder.Codec]; ok {
+		return codec.extension
+	}
+	return strings.ToLower(filepath.Ext(srcFile))
+}
+
+// needsEncoder checks if the given source file has to be processed by the
+// encoder. MP3 files are tagged directly unless a target codec is set.
+func (u *Uploader) needsEncoder(srcFile string) bool {
+	return u.encoder.Codec != "" || strings.ToLower(filepath.Ext(srcFile)) != ".mp3"
+}
+
+// encode runs the encoder on the given source file and writes the result
+// with the given tags to the destination. Without a target codec, the
+// audio stream is copied unchanged.
+func (u *Uploader) encode(srcFile string, destFile string, artist string, album string, title string, track int) error {
+	args := []string{"-y", "-loglevel", "error", "-i", srcFile, "-vn", "-map_metadata", "-1"}
+	if codec, ok := targetCodecs[u.encoder.Codec]; ok {
+		args = append(args, "-c:a", codec.library)
+		if u.encoder.Bitrate != "" {
+			args = append(args, "-b:a", u.encoder.Bitrate)
+		}
+	} else {
+		args = append(args, "-c:a", "copy")
+	}
+	args = append(args,
+		"-metadata", "artist=" + artist,
+		"-metadata", "album=" + album,
+		"-metadata", "title=" + title,
+		"-metadata", "track=" + strconv.Itoa(track),
+		destFile)
+	log.Printf("[uploader] encoding %s to %s using %s", srcFile, destFile, u.encoder.Path)
+	output, err := exec.Command(u.encoder.Path, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("[uploader] encoding %s failed: %v: %s", srcFile, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
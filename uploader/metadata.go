@@ -0,0 +1,214 @@
+package uploader
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dhowden/tag"
+)
+
+// trackMetadata describes the metadata read from a source file.
+type trackMetadata struct {
+	Filename string
+	Title    string
+	Track    int
+	Disc     int
+	Duration time.Duration
+	Picture  *tag.Picture
+}
+
+// readTrackMetadata reads the ID3, Vorbis or MP4 tags and the duration of
+// the given file. Files without tags get the filename as title.
+func readTrackMetadata(path string) (*trackMetadata, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	filename := filepath.Base(path)
+	metadata := &trackMetadata{
+		Filename: filename,
+		Title:    strings.TrimSuffix(filename, filepath.Ext(filename)),
+	}
+	tags, err := tag.ReadFrom(file)
+	if err != nil {
+		log.Printf("[uploader] no tags read from %s: %s", path, err.Error())
+	} else {
+		if tags.Title() != "" {
+			metadata.Title = tags.Title()
+		}
+		metadata.Track, _ = tags.Track()
+		metadata.Disc, _ = tags.Disc()
+		metadata.Picture = tags.Picture()
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".mp3":
+		metadata.Duration, err = readMP3Duration(file)
+	case ".flac":
+		metadata.Duration, err = readFLACDuration(file)
+	}
+	if err != nil {
+		log.Printf("[uploader] unable to read duration of %s: %s", path, err.Error())
+	}
+	return metadata, nil
+}
+
+// sortTracks orders the tracks by disc and track number. Tracks without
+// number follow the numbered tracks in filename order.
+func sortTracks(tracks []*trackMetadata) {
+	sort.SliceStable(tracks, func(i, j int) bool {
+		if (tracks[i].Track == 0) != (tracks[j].Track == 0) {
+			return tracks[j].Track == 0
+		}
+		if tracks[i].Disc != tracks[j].Disc {
+			return tracks[i].Disc < tracks[j].Disc
+		}
+		if tracks[i].Track != tracks[j].Track {
+			return tracks[i].Track < tracks[j].Track
+		}
+		return tracks[i].Filename < tracks[j].Filename
+	})
+}
+
+// skipID3v2 skips an ID3v2 tag at the current position of the reader.
+func skipID3v2(r *bufio.Reader) error {
+	header, err := r.Peek(10)
+	if err != nil || string(header[0:3]) != "ID3" {
+		return nil
+	}
+	// the tag size is stored as a syncsafe integer.
+	size := int(header[6])<<21 | int(header[7])<<14 | int(header[8])<<7 | int(header[9])
+	size += 10
+	if header[5]&0x10 != 0 {
+		// footer present.
+		size += 10
+	}
+	_, err = r.Discard(size)
+	return err
+}
+
+var (
+	mp3BitratesV1 = [3][16]int{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	}
+	mp3BitratesV2 = [3][16]int{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+	}
+	mp3SampleRates = map[byte][3]int{
+		0: {11025, 12000, 8000},  // MPEG 2.5
+		2: {22050, 24000, 16000}, // MPEG 2
+		3: {44100, 48000, 32000}, // MPEG 1
+	}
+)
+
+// readMP3Duration calculates the duration of an MP3 stream by summing up
+// the samples of all frames.
+func readMP3Duration(file io.Reader) (time.Duration, error) {
+	r := bufio.NewReader(file)
+	if err := skipID3v2(r); err != nil {
+		return 0, err
+	}
+	totalSamples := map[int]int{}
+	for {
+		header, err := r.Peek(4)
+		if err != nil {
+			// end of stream.
+			break
+		}
+		frameLength, samples, sampleRate := parseMP3FrameHeader(header)
+		if frameLength == 0 {
+			// no frame header, resync on the next byte.
+			r.Discard(1)
+			continue
+		}
+		totalSamples[sampleRate] += samples
+		if _, err := r.Discard(frameLength); err != nil {
+			break
+		}
+	}
+	var duration time.Duration
+	for sampleRate, samples := range totalSamples {
+		duration += time.Duration(samples) * time.Second / time.Duration(sampleRate)
+	}
+	return duration, nil
+}
+
+// parseMP3FrameHeader returns the frame length in bytes, the number of
+// samples and the sample rate of the frame. The frame length is zero if
+// the given bytes are no valid frame header.
+func parseMP3FrameHeader(header []byte) (int, int, int) {
+	if header[0] != 0xFF || header[1]&0xE0 != 0xE0 {
+		return 0, 0, 0
+	}
+	version := (header[1] >> 3) & 0x03
+	layer := (header[1] >> 1) & 0x03
+	bitrateIndex := (header[2] >> 4) & 0x0F
+	sampleRateIndex := (header[2] >> 2) & 0x03
+	padding := int((header[2] >> 1) & 0x01)
+	sampleRates, ok := mp3SampleRates[version]
+	if !ok || layer == 0 || sampleRateIndex == 3 {
+		return 0, 0, 0
+	}
+	// layer index 0 is layer I, 1 is layer II, 2 is layer III.
+	layerIndex := 3 - int(layer)
+	bitrate := mp3BitratesV1[layerIndex][bitrateIndex]
+	if version != 3 {
+		bitrate = mp3BitratesV2[layerIndex][bitrateIndex]
+	}
+	if bitrate == 0 {
+		return 0, 0, 0
+	}
+	bitrate *= 1000
+	sampleRate := sampleRates[sampleRateIndex]
+	switch layerIndex {
+	case 0:
+		return (12*bitrate/sampleRate + padding) * 4, 384, sampleRate
+	case 1:
+		return 144*bitrate/sampleRate + padding, 1152, sampleRate
+	default:
+		if version != 3 {
+			return 72*bitrate/sampleRate + padding, 576, sampleRate
+		}
+		return 144*bitrate/sampleRate + padding, 1152, sampleRate
+	}
+}
+
+// readFLACDuration reads the duration of a FLAC stream from its
+// STREAMINFO block.
+func readFLACDuration(file io.Reader) (time.Duration, error) {
+	r := bufio.NewReader(file)
+	if err := skipID3v2(r); err != nil {
+		return 0, err
+	}
+	// "fLaC" marker, metadata block header and the STREAMINFO block.
+	header := make([]byte, 4+4+34)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+	if string(header[0:4]) != "fLaC" || header[4]&0x7F != 0 {
+		return 0, nil
+	}
+	// sample rate (20 bits), channels (3 bits), bits per sample (5 bits)
+	// and total samples (36 bits).
+	info := binary.BigEndian.Uint64(header[18:26])
+	sampleRate := info >> 44
+	totalSamples := info & (1<<36 - 1)
+	if sampleRate == 0 {
+		return 0, nil
+	}
+	return time.Duration(float64(totalSamples) / float64(sampleRate) * float64(time.Second)), nil
+}
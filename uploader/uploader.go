@@ -3,29 +3,66 @@ package uploader
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/dhowden/tag"
 	"github.com/michaelkleinhenz/piena/base"
 	id3 "github.com/mikkyang/id3-go"
+	v2 "github.com/mikkyang/id3-go/v2"
 	/*
 		"github.com/michaelkleinhenz/piena/base"
 		"github.com/michaelkleinhenz/piena/downloader"
 	*/)
 
+const (
+	// directoryKey is the key of the directory file in the bucket.
+	directoryKey = "directory.json"
+	// maxDirectoryUpdateAttempts is the number of times a directory update
+	// is retried when the directory was changed concurrently.
+	maxDirectoryUpdateAttempts = 5
+	// directoryRetryDelay is the base delay between directory update attempts.
+	directoryRetryDelay = 500 * time.Millisecond
+	// defaultEncoder is the encoder used if none is configured.
+	defaultEncoder = "ffmpeg"
+)
+
+// AudiobookDetails are the optional descriptive fields of an audiobook.
+type AudiobookDetails struct {
+	// CoverImage is the uploaded cover as returned by UploadCoverFile.
+	CoverImage  string `yaml:"coverImage"`
+	Description string `yaml:"description"`
+	Series      string `yaml:"series"`
+	SeriesIndex int    `yaml:"seriesIndex"`
+	AgeRating   int    `yaml:"ageRating"`
+	Language    string `yaml:"language"`
+}
+
 // Uploader is the downloader for audiobooks.
 type Uploader struct {
 	tempDir string
+	session *session.Session
+	coverFile string
+	encoder EncoderOptions
+	signingKey ed25519.PrivateKey
 }
 
 // NewUploader returns a new uploader instance.
@@ -36,53 +73,101 @@ func NewUploader() (*Uploader, error) {
 	if err != nil {
 		return nil, err
 	}
+	uploader.session, err = session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	uploader.encoder = EncoderOptions{Path: defaultEncoder}
 	return uploader, nil
 }
 
-func (u *Uploader) TagRenameFiles(uploadFileDir string, uploadArtist string, uploadTitle string) ([]string, error) {
-	uploadFiles := []string{}
-	err := filepath.Walk(uploadFileDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.Name() != filepath.Base(uploadFileDir) {
-			uploadFiles = append(uploadFiles, info.Name())
-		}
-		return nil
-	})
+// SetSigningKey sets the key the directory is signed with. Without signing
+// key, the directory is uploaded without signature and is refused by
+// players verifying signatures.
+func (u *Uploader) SetSigningKey(key ed25519.PrivateKey) {
+	u.signingKey = key
+}
+
+// TagRenameFiles copies the audio files in the given directory to the
+// upload directory, ordered by disc and track number of the source files.
+// The copies are renamed to their position in the audiobook and tagged with
+// the given artist and title. Files that are not MP3 files or that need to
+// be transcoded are processed by the encoder. Returns the tracks with the
+// titles and durations read from the source files.
+func (u *Uploader) TagRenameFiles(uploadFileDir string, uploadArtist string, uploadTitle string) ([]base.AudiobookTrack, error) {
+	entries, err := ioutil.ReadDir(uploadFileDir)
 	if err != nil {
 		return nil, err
 	}
+	uploadFiles := []string{}
+	for _, entry := range(entries) {
+		if !entry.Mode().IsRegular() || !isAudioFile(entry.Name()) {
+			log.Printf("[uploader] skipping %s, not an audio file", entry.Name())
+			continue
+		}
+		uploadFiles = append(uploadFiles, entry.Name())
+	}
+	if len(uploadFiles) == 0 {
+		return nil, fmt.Errorf("[uploader] no audio files found in %s", uploadFileDir)
+	}
+	u.coverFile = ""
 	// sort files
 	sort.Strings(uploadFiles)
 	log.Printf("[uploader] found files in %s: %s", uploadFileDir, uploadFiles)
-	packageFiles := []string{}
-	for idx, filename := range(uploadFiles) {
-		srcFile := uploadFileDir + "/" + filename
-		destTitle := fmt.Sprintf("%02d", idx+1)
-		destFilename := destTitle + ".mp3"
-		destFilePath := u.tempDir + "/" + destFilename
-		log.Printf("[uploader] copy/tagging file %s to destination %s", srcFile, destFilePath)
-		// copy file.
-		u.copyFile(srcFile, destFilePath)
-		// tag file.
-		mp3File, err := id3.Open(destFilePath)
+	// read metadata and order by track numbers
+	sourceTracks := []*trackMetadata{}
+	for _, filename := range(uploadFiles) {
+		metadata, err := readTrackMetadata(uploadFileDir + "/" + filename)
 		if err != nil {
 			return nil, err
 		}
-		mp3File.SetArtist(uploadArtist)
-		mp3File.SetAlbum(uploadTitle)
-		mp3File.SetTitle(destTitle)
-		err = mp3File.Close()
-		if err != nil {
-			return nil, err
+		sourceTracks = append(sourceTracks, metadata)
+	}
+	sortTracks(sourceTracks)
+	tracks := []base.AudiobookTrack{}
+	for idx, source := range(sourceTracks) {
+		srcFile := uploadFileDir + "/" + source.Filename
+		ord := fmt.Sprintf("%02d", idx+1)
+		destFilename := ord + u.targetExtension(srcFile)
+		destFilePath := u.tempDir + "/" + destFilename
+		if u.needsEncoder(srcFile) {
+			err = u.encode(srcFile, destFilePath, uploadArtist, uploadTitle, source.Title, idx+1)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			err = u.copyTagMP3File(srcFile, destFilePath, uploadArtist, uploadTitle, source.Title, idx+1)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// keep the first cover art found.
+		if u.coverFile == "" && source.Picture != nil {
+			err = u.writeCoverFile(source.Picture)
+			if err != nil {
+				return nil, err
+			}
 		}
-		packageFiles = append(packageFiles, destFilename)
+		tracks = append(tracks, base.AudiobookTrack{
+			Ord: idx+1,
+			Title: source.Title,
+			Filename: destFilename,
+			Duration: int(source.Duration.Seconds()),
+		})
 	}
-	return packageFiles, nil
+	return tracks, nil
 }
 
-func (u *Uploader) PackageFiles(packageFiles []string, artist string, title string) (string, error) {
+// PackageFiles creates the package file for the given tracks. The cover art
+// found in the source files is added to the package.
+func (u *Uploader) PackageFiles(tracks []base.AudiobookTrack, artist string, title string) (string, error) {
+	packageFiles := []string{}
+	for _, track := range(tracks) {
+		packageFiles = append(packageFiles, track.Filename)
+	}
+	if u.coverFile != "" {
+		packageFiles = append(packageFiles, u.coverFile)
+	}
 	// TODO: escape strings here
 	packageFilename := u.tempDir + "/" + artist + " - " + title + ".zip"
 	log.Printf("[uploader] creating package file %s from files %s", packageFilename, packageFiles)
@@ -95,8 +180,7 @@ func (u *Uploader) PackageFiles(packageFiles []string, artist string, title stri
 
 func (u *Uploader) UploadPackageFile(packageFile string, bucket string) error {
 	log.Printf("[uploader] starting file upload: %s", packageFile)
-	sess := session.Must(session.NewSession())
-	uploader := s3manager.NewUploader(sess)
+	uploader := s3manager.NewUploader(u.session)
 	f, err  := os.Open(packageFile)
 	if err != nil {
 		return fmt.Errorf("failed to open file %q: %v", packageFile, err)
@@ -113,64 +197,256 @@ func (u *Uploader) UploadPackageFile(packageFile string, bucket string) error {
 	return nil
 }
 
-func (u *Uploader) UpdateDirectory(packageFile string, uploadID string, uploadArtist string, uploadTitle string, bucket string) error {
+// UploadCoverFile uploads the cover art found in the source files to the
+// bucket. Returns the name of the uploaded file or an empty string if the
+// source files had no cover art. Must be called before PackageFiles.
+func (u *Uploader) UploadCoverFile(artist string, title string, bucket string) (string, error) {
+	if u.coverFile == "" {
+		log.Println("[uploader] no cover art found, skipping cover upload")
+		return "", nil
+	}
+	f, err := os.Open(u.tempDir + "/" + u.coverFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	// TODO: escape strings here
+	coverKey := artist + " - " + title + filepath.Ext(u.coverFile)
+	log.Printf("[uploader] uploading cover art as %s", coverKey)
+	uploader := s3manager.NewUploader(u.session)
+	_, err = uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(coverKey),
+		Body:   f,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload cover: %v", err)
+	}
+	return coverKey, nil
+}
+
+// UpdateDirectory adds the audiobook in the given package file to the
+// directory in the bucket. An existing entry with the same ID is replaced.
+func (u *Uploader) UpdateDirectory(packageFile string, tracks []base.AudiobookTrack, uploadID string, uploadArtist string, uploadTitle string, details AudiobookDetails, bucket string) error {
 	log.Println("[uploader] start updating directory")
-	// download directory from bucket
-	sess := session.Must(session.NewSession())
-	downloader := s3manager.NewDownloader(sess)
-	buf := &aws.WriteAtBuffer{}
-	n, err := downloader.Download(buf, &s3.GetObjectInput{
-    Bucket: aws.String(bucket),
-    Key:    aws.String("directory.json"),
+	audiobook := newAudiobook(packageFile, tracks, uploadID, uploadArtist, uploadTitle, details)
+	return u.updateDirectory(bucket, func(directory *base.AudiobookDirectory) {
+		addOrReplaceAudiobook(directory, audiobook)
 	})
+}
+
+// updateDirectory applies the given change to the directory in the bucket.
+// The updated directory is only written if the directory in the bucket is
+// still the version the change was applied to. If another upload changed
+// the directory in the meantime, the directory is fetched again and the
+// change is re-applied to the new version.
+func (u *Uploader) updateDirectory(bucket string, change func(*base.AudiobookDirectory)) error {
+	for attempt := 1; attempt <= maxDirectoryUpdateAttempts; attempt++ {
+		directory, etag, err := u.fetchDirectory(bucket)
+		if err != nil {
+			return err
+		}
+		change(directory)
+		err = u.putDirectory(bucket, directory, etag)
+		if err == nil {
+			return nil
+		}
+		if !isConcurrentModification(err) {
+			return err
+		}
+		log.Printf("[uploader] directory was changed concurrently, retrying (attempt %d of %d)", attempt, maxDirectoryUpdateAttempts)
+		time.Sleep(time.Duration(attempt) * directoryRetryDelay)
+	}
+	return errors.New("failed to update directory: too many concurrent modifications")
+}
+
+// fetchDirectory downloads the directory from the bucket, migrates it to
+// the current schema version and returns it together with its ETag. If the
+// bucket does not contain a directory yet, an empty directory and an empty
+// ETag are returned.
+func (u *Uploader) fetchDirectory(bucket string) (*base.AudiobookDirectory, string, error) {
+	directoryBytes, etag, err := u.fetchDirectoryBytes(bucket)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			log.Println("[uploader] no directory in bucket, creating a new one")
+			directory := new(base.AudiobookDirectory)
+			directory.SchemaVersion = base.DirectorySchemaVersion
+			return directory, "", nil
+		}
+		return nil, "", fmt.Errorf("failed to download directory: %v", err)
+	}
+	directory, err := base.ParseDirectory(directoryBytes)
 	if err != nil {
-    return fmt.Errorf("failed to download file: %v", err)
+		return nil, "", err
 	}
-	log.Printf("[uploader] directory fetched, %d bytes", n)
-	directory := new(base.AudiobookDirectory)
-	json.Unmarshal(buf.Bytes(), directory)
 	log.Println("[uploader] unmarshalled directory")
-	// list files in packageFile
-	zipFile, err := zip.OpenReader(packageFile)
+	// upgrade the directory before changing it, directories written by a
+	// newer version are refused so their unknown fields are not lost.
+	err = base.MigrateDirectory(directory)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
-	defer zipFile.Close()
-	uploadFiles := []string{}
-	for _, zipEntry := range zipFile.File {
-		uploadFiles = append(uploadFiles, zipEntry.FileInfo().Name())
+	return directory, etag, nil
+}
+
+// fetchDirectoryBytes downloads the directory content from the bucket and
+// returns it together with its ETag.
+func (u *Uploader) fetchDirectoryBytes(bucket string) ([]byte, string, error) {
+	client := s3.New(u.session)
+	result, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(directoryKey),
+	})
+	if err != nil {
+		return nil, "", err
 	}
-	// create new entry
-	tracks := []base.AudiobookTrack{}
-	for idx, filename := range(uploadFiles) {
-		tracks = append(tracks, base.AudiobookTrack{
-			Ord: idx+1,
-			Filename: filename,
-			Title: filename,
+	defer result.Body.Close()
+	directoryBytes, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	log.Printf("[uploader] directory fetched, %d bytes, etag %s", len(directoryBytes), aws.StringValue(result.ETag))
+	return directoryBytes, aws.StringValue(result.ETag), nil
+}
+
+// putDirectory uploads the directory to the bucket. The upload fails with a
+// precondition error if the directory in the bucket does not match the given
+// ETag anymore. An empty ETag requires that no directory exists yet.
+func (u *Uploader) putDirectory(bucket string, directory *base.AudiobookDirectory, etag string) error {
+	uploadBytes, err := json.Marshal(directory)
+	if err != nil {
+		return fmt.Errorf("failed to marshall updated directory: %v", err)
+	}
+	precondition := map[string]string{"If-None-Match": "*"}
+	if etag != "" {
+		precondition = map[string]string{"If-Match": etag}
+	}
+	client := s3.New(u.session)
+	result, err := client.PutObjectWithContext(aws.BackgroundContext(), &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(directoryKey),
+		Body:        bytes.NewReader(uploadBytes),
+		ContentType: aws.String("application/json"),
+	}, request.WithSetRequestHeaders(precondition))
+	if err != nil {
+		return fmt.Errorf("failed to upload directory: %w", err)
+	}
+	log.Printf("[uploader] directory uploaded to bucket %s", bucket)
+	return u.putDirectorySignature(bucket, uploadBytes, aws.StringValue(result.ETag))
+}
+
+// putDirectorySignature uploads the detached signature of the uploaded
+// directory content with the given ETag. The signature is written after the
+// directory, so a concurrent upload may have replaced the directory and its
+// signature in the meantime. The directory in the bucket is read back after
+// writing the signature, and signed again if it is not the signed one.
+func (u *Uploader) putDirectorySignature(bucket string, directoryBytes []byte, etag string) error {
+	if u.signingKey == nil {
+		log.Println("[uploader] no signing key given, directory is not signed")
+		return nil
+	}
+	client := s3.New(u.session)
+	for attempt := 1; attempt <= maxDirectoryUpdateAttempts; attempt++ {
+		_, err := client.PutObject(&s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(directoryKey + base.SignatureSuffix),
+			Body:        bytes.NewReader(base.SignDirectory(directoryBytes, u.signingKey)),
+			ContentType: aws.String("text/plain"),
 		})
+		if err != nil {
+			return fmt.Errorf("failed to upload directory signature: %v", err)
+		}
+		currentBytes, currentETag, err := u.fetchDirectoryBytes(bucket)
+		if err != nil {
+			return fmt.Errorf("failed to verify directory signature: %v", err)
+		}
+		if currentETag == etag {
+			log.Printf("[uploader] directory signature uploaded to bucket %s", bucket)
+			return nil
+		}
+		log.Printf("[uploader] directory was changed while signing, signing the current directory (attempt %d of %d)", attempt, maxDirectoryUpdateAttempts)
+		directoryBytes, etag = currentBytes, currentETag
+	}
+	return errors.New("failed to sign directory: too many concurrent modifications")
+}
+
+// isConcurrentModification checks if the error was caused by a failed
+// precondition on a directory upload.
+func isConcurrentModification(err error) bool {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		return reqErr.StatusCode() == http.StatusPreconditionFailed || reqErr.StatusCode() == http.StatusConflict
+	}
+	return false
+}
+
+// newAudiobook creates the directory entry for an uploaded package file.
+func newAudiobook(packageFile string, tracks []base.AudiobookTrack, uploadID string, uploadArtist string, uploadTitle string, details AudiobookDetails) base.Audiobook {
+	duration := 0
+	for _, track := range tracks {
+		duration += track.Duration
 	}
-	directory.Books = append(directory.Books, base.Audiobook{
+	return base.Audiobook{
 		ID: uploadID,
 		ArchiveFile: filepath.Base(packageFile),
 		Artist: uploadArtist,
 		Title: uploadTitle,
 		Tracks: tracks,
-	})
-	// serialize and upload
-	uploadBytes, err := json.Marshal(directory)
+		CoverImage: details.CoverImage,
+		Description: details.Description,
+		Series: details.Series,
+		SeriesIndex: details.SeriesIndex,
+		AgeRating: details.AgeRating,
+		Language: details.Language,
+		Duration: duration,
+	}
+}
+
+// addOrReplaceAudiobook adds the audiobook to the directory, replacing an
+// existing entry with the same ID.
+func addOrReplaceAudiobook(directory *base.AudiobookDirectory, audiobook base.Audiobook) {
+	for idx := range directory.Books {
+		if base.TagIDsMatch(directory.Books[idx].ID, audiobook.ID) {
+			log.Printf("[uploader] replacing existing directory entry for %s", audiobook.ID)
+			directory.Books[idx] = audiobook
+			return
+		}
+	}
+	directory.Books = append(directory.Books, audiobook)
+}
+
+// copyTagMP3File copies the given MP3 file to the destination and tags it.
+func (u *Uploader) copyTagMP3File(srcFile string, destFile string, artist string, album string, title string, track int) error {
+	log.Printf("[uploader] copy/tagging file %s (%s) to destination %s", srcFile, title, destFile)
+	err := u.copyFile(srcFile, destFile)
 	if err != nil {
-    return fmt.Errorf("failed to marshall updated directory: %v", err)
+		return err
 	}
-	uploader := s3manager.NewUploader(sess)
-	result, err := uploader.Upload(&s3manager.UploadInput{
-    Bucket: aws.String(bucket),
-    Key:    aws.String("directory.json"),
-    Body:   bytes.NewReader(uploadBytes),
-	})
+	mp3File, err := id3.Open(destFile)
 	if err != nil {
-    return fmt.Errorf("failed to upload file %v", err)
+		return err
+	}
+	mp3File.SetArtist(artist)
+	mp3File.SetAlbum(album)
+	mp3File.SetTitle(title)
+	mp3File.DeleteFrames("TRCK")
+	mp3File.AddFrames(v2.NewTextFrame(v2.V23FrameTypeMap["TRCK"], strconv.Itoa(track)))
+	return mp3File.Close()
+}
+
+// writeCoverFile stores the given cover art in the upload directory.
+func (u *Uploader) writeCoverFile(picture *tag.Picture) error {
+	ext := picture.Ext
+	if ext == "" {
+		ext = "jpg"
+	}
+	coverFile := "cover." + strings.ToLower(ext)
+	log.Printf("[uploader] storing cover art (%s) as %s", picture.MIMEType, coverFile)
+	err := ioutil.WriteFile(u.tempDir + "/" + coverFile, picture.Data, 0644)
+	if err != nil {
+		return err
 	}
-	log.Printf("[uploader] directory uploaded to %s\n", result.Location)
+	u.coverFile = coverFile
 	return nil
 }
 
@@ -2,15 +2,28 @@ package uploader
 
 import (
 	"archive/zip"
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
 	id3 "github.com/mikkyang/id3-go"
+	v2 "github.com/mikkyang/id3-go/v2"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/michaelkleinhenz/piena/base"
 )
 
 const (
@@ -19,23 +32,27 @@ const (
 )
 
 func TestDownloader(t *testing.T) {
-	// create temp directory
-	path, err := ioutil.TempDir("", "piena-")
-	assert.NoError(t, err)
-	defer os.RemoveAll(path)
 	uploader, err := NewUploader()
 	assert.NoError(t, err)
 	exampleMP3Info, err := os.Stat(exampleMP3Path)
 	assert.NoError(t, err)
 	t.Run("tagging files", func(t *testing.T) {
 		// create example source dir
-		_, err := createSourceMP3Dir(path)
+		path, err := ioutil.TempDir("", "piena-")
+		assert.NoError(t, err)
 		defer os.RemoveAll(path)
+		_, err = createSourceMP3Dir(path)
 		assert.NoError(t, err)
-		packageFiles, err := uploader.TagRenameFiles(path, "Example Artist", "Example Album Title")
+		tracks, err := uploader.TagRenameFiles(path, "Example Artist", "Example Album Title")
 		assert.NoError(t, err)
-		for i, packageFile := range(packageFiles) {
-			destFile := uploader.tempDir + "/" + packageFile
+		assert.Len(t, tracks, numTracks)
+		for i, track := range(tracks) {
+			destFile := uploader.tempDir + "/" + track.Filename
+			assert.Equal(t, i+1, track.Ord)
+			assert.Equal(t, fmt.Sprintf("%02d.mp3", i+1), track.Filename)
+			// untagged files are titled by their filename
+			expectedTitle := "track-" + strconv.Itoa(i+1)
+			assert.Equal(t, expectedTitle, track.Title)
 			// check if file exists
 			_, err = os.Stat(destFile)
 			assert.NoError(t, err)
@@ -44,7 +61,31 @@ func TestDownloader(t *testing.T) {
 			assert.NoError(t, err)
 			assert.Equal(t, "Example Artist", mp3File.Artist())
 			assert.Equal(t, "Example Album Title", mp3File.Album())
-			expectedTitle := fmt.Sprintf("%02d", i)
+			assert.Equal(t, expectedTitle, mp3File.Title())
+			err = mp3File.Close()
+			assert.NoError(t, err)
+		}
+	})
+	t.Run("ordering by track number", func(t *testing.T) {
+		// create example source dir with tracks numbered in reverse
+		path, err := ioutil.TempDir("", "piena-")
+		assert.NoError(t, err)
+		defer os.RemoveAll(path)
+		_, err = createSourceMP3Dir(path)
+		assert.NoError(t, err)
+		for i := 1; i <= numTracks; i++ {
+			ord := numTracks-i+1
+			err = tagSourceFile(path + "/track-" + strconv.Itoa(i) + ".mp3", "Chapter " + strconv.Itoa(ord), ord)
+			assert.NoError(t, err)
+		}
+		tracks, err := uploader.TagRenameFiles(path, "Example Artist", "Example Album Title")
+		assert.NoError(t, err)
+		assert.Len(t, tracks, numTracks)
+		for i, track := range(tracks) {
+			expectedTitle := "Chapter " + strconv.Itoa(i+1)
+			assert.Equal(t, expectedTitle, track.Title)
+			mp3File, err := id3.Open(uploader.tempDir + "/" + track.Filename)
+			assert.NoError(t, err)
 			assert.Equal(t, expectedTitle, mp3File.Title())
 			err = mp3File.Close()
 			assert.NoError(t, err)
@@ -52,12 +93,18 @@ func TestDownloader(t *testing.T) {
 	})
 	t.Run("creating package file", func(t *testing.T) {
 		// create example source dir
-		_, err := createSourceMP3Dir(path)
+		path, err := ioutil.TempDir("", "piena-")
+		assert.NoError(t, err)
 		defer os.RemoveAll(path)
+		_, err = createSourceMP3Dir(path)
 		assert.NoError(t, err)
-		packageFiles, err := uploader.TagRenameFiles(path, "Example Artist", "Example Album Title")
+		tracks, err := uploader.TagRenameFiles(path, "Example Artist", "Example Album Title")
 		assert.NoError(t, err)
-		packageFile, err := uploader.PackageFiles(packageFiles, "Example Artist", "Example Album Title")
+		packageFiles := []string{}
+		for _, track := range(tracks) {
+			packageFiles = append(packageFiles, track.Filename)
+		}
+		packageFile, err := uploader.PackageFiles(tracks, "Example Artist", "Example Album Title")
 		assert.NoError(t, err)
 		// check if package file exists
 		_, err = os.Stat(packageFile)
@@ -78,6 +125,313 @@ func TestDownloader(t *testing.T) {
 	})	
 }
 
+func TestEncoding(t *testing.T) {
+	uploader, err := NewUploader()
+	assert.NoError(t, err)
+	path, err := ioutil.TempDir("", "piena-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(path)
+	encoder, encoderLog, err := createFakeEncoder(path)
+	assert.NoError(t, err)
+	t.Run("filtering source files", func(t *testing.T) {
+		sourceDir, err := ioutil.TempDir("", "piena-")
+		assert.NoError(t, err)
+		defer os.RemoveAll(sourceDir)
+		_, err = createSourceMP3Dir(sourceDir)
+		assert.NoError(t, err)
+		assert.NoError(t, ioutil.WriteFile(sourceDir + "/cover.jpg", []byte("image"), 0644))
+		assert.NoError(t, ioutil.WriteFile(sourceDir + "/notes.txt", []byte("notes"), 0644))
+		assert.NoError(t, os.Mkdir(sourceDir + "/extras", 0755))
+		assert.NoError(t, copyFile(exampleMP3Path, sourceDir + "/extras/bonus.mp3"))
+		tracks, err := uploader.TagRenameFiles(sourceDir, "Example Artist", "Example Album Title")
+		assert.NoError(t, err)
+		assert.Len(t, tracks, numTracks)
+	})
+	t.Run("tagging non-mp3 files", func(t *testing.T) {
+		sourceDir, err := ioutil.TempDir("", "piena-")
+		assert.NoError(t, err)
+		defer os.RemoveAll(sourceDir)
+		assert.NoError(t, ioutil.WriteFile(sourceDir + "/01.flac", []byte("flac"), 0644))
+		assert.NoError(t, ioutil.WriteFile(sourceDir + "/02.wav", []byte("wav"), 0644))
+		assert.NoError(t, uploader.SetEncoderOptions(EncoderOptions{Path: encoder}))
+		tracks, err := uploader.TagRenameFiles(sourceDir, "Example Artist", "Example Album Title")
+		assert.NoError(t, err)
+		assert.Len(t, tracks, 2)
+		assert.Equal(t, "01.flac", tracks[0].Filename)
+		assert.Equal(t, "02.wav", tracks[1].Filename)
+		assert.FileExists(t, uploader.tempDir + "/01.flac")
+		args, err := ioutil.ReadFile(encoderLog)
+		assert.NoError(t, err)
+		assert.Contains(t, string(args), "-c:a copy")
+		assert.Contains(t, string(args), "-metadata album=Example Album Title")
+	})
+	t.Run("transcoding files", func(t *testing.T) {
+		sourceDir, err := ioutil.TempDir("", "piena-")
+		assert.NoError(t, err)
+		defer os.RemoveAll(sourceDir)
+		_, err = createSourceMP3Dir(sourceDir)
+		assert.NoError(t, err)
+		assert.NoError(t, uploader.SetEncoderOptions(EncoderOptions{Path: encoder, Codec: "opus", Bitrate: "64k"}))
+		tracks, err := uploader.TagRenameFiles(sourceDir, "Example Artist", "Example Album Title")
+		assert.NoError(t, err)
+		assert.Len(t, tracks, numTracks)
+		for i, track := range(tracks) {
+			assert.Equal(t, fmt.Sprintf("%02d.opus", i+1), track.Filename)
+			assert.FileExists(t, uploader.tempDir + "/" + track.Filename)
+		}
+		args, err := ioutil.ReadFile(encoderLog)
+		assert.NoError(t, err)
+		assert.Contains(t, string(args), "-c:a libopus -b:a 64k")
+		assert.Contains(t, string(args), "-metadata title=track-1")
+	})
+	t.Run("rejecting unknown codec", func(t *testing.T) {
+		assert.Error(t, uploader.SetEncoderOptions(EncoderOptions{Path: encoder, Codec: "wma"}))
+	})
+}
+
+func TestUpdateDirectory(t *testing.T) {
+	bucket := newFakeBucket()
+	ts := httptest.NewServer(bucket)
+	defer ts.Close()
+	uploader, err := NewUploader()
+	assert.NoError(t, err)
+	uploader.session = newFakeSession(t, ts.URL)
+	t.Run("creating directory", func(t *testing.T) {
+		err := uploader.updateDirectory("tiena-files", func(directory *base.AudiobookDirectory) {
+			addOrReplaceAudiobook(directory, base.Audiobook{ID: "111", Artist: "aa", Title: "ta"})
+		})
+		assert.NoError(t, err)
+		directory := bucket.directory(t)
+		assert.Len(t, directory.Books, 1)
+		assert.Equal(t, "111", directory.Books[0].ID)
+	})
+	t.Run("replacing entry", func(t *testing.T) {
+		err := uploader.updateDirectory("tiena-files", func(directory *base.AudiobookDirectory) {
+			addOrReplaceAudiobook(directory, base.Audiobook{ID: "111", Artist: "aa", Title: "tb"})
+		})
+		assert.NoError(t, err)
+		directory := bucket.directory(t)
+		assert.Len(t, directory.Books, 1)
+		assert.Equal(t, "tb", directory.Books[0].Title)
+	})
+	t.Run("merging concurrent update", func(t *testing.T) {
+		// another uploader adds a book between our download and our upload.
+		bucket.beforePut = func() {
+			directory := bucket.directory(t)
+			directory.Books = append(directory.Books, base.Audiobook{ID: "222", Artist: "ab", Title: "tc"})
+			directoryBytes, _ := json.Marshal(directory)
+			bucket.put(directoryBytes)
+		}
+		attempts := 0
+		err := uploader.updateDirectory("tiena-files", func(directory *base.AudiobookDirectory) {
+			attempts++
+			addOrReplaceAudiobook(directory, base.Audiobook{ID: "333", Artist: "ac", Title: "td"})
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, attempts)
+		directory := bucket.directory(t)
+		assert.Len(t, directory.Books, 3)
+		assert.Equal(t, "111", directory.Books[0].ID)
+		assert.Equal(t, "222", directory.Books[1].ID)
+		assert.Equal(t, "333", directory.Books[2].ID)
+	})
+	t.Run("migrating legacy directory", func(t *testing.T) {
+		bucket.put([]byte(`{"id":"dir","books":[{"id":"111","artist":"aa","title":"ta","archiveFile":"aa - ta.zip","tracks":[{"ord":1,"title":"01.mp3","filename":"01.mp3"}]}]}`))
+		err := uploader.updateDirectory("tiena-files", func(directory *base.AudiobookDirectory) {
+			addOrReplaceAudiobook(directory, base.Audiobook{ID: "222", Artist: "ab", Title: "tb"})
+		})
+		assert.NoError(t, err)
+		directory := bucket.directory(t)
+		assert.Equal(t, base.DirectorySchemaVersion, directory.SchemaVersion)
+		assert.Len(t, directory.Books, 2)
+		assert.Equal(t, "01", directory.Books[0].Tracks[0].Title)
+	})
+	t.Run("signing directory", func(t *testing.T) {
+		privateKey, publicKey, err := base.GenerateSigningKey()
+		assert.NoError(t, err)
+		keyFile := filepath.Join(uploader.tempDir, "signing.key")
+		assert.NoError(t, ioutil.WriteFile(keyFile, []byte(privateKey), 0600))
+		signingKey, err := base.LoadSigningKey(keyFile)
+		assert.NoError(t, err)
+		uploader.SetSigningKey(signingKey)
+		defer uploader.SetSigningKey(nil)
+		err = uploader.updateDirectory("tiena-files", func(directory *base.AudiobookDirectory) {
+			addOrReplaceAudiobook(directory, base.Audiobook{ID: "444", Artist: "ad", Title: "te"})
+		})
+		assert.NoError(t, err)
+		verifyKey, err := base.ParsePublicKey(publicKey)
+		assert.NoError(t, err)
+		signature := bucket.objects["/tiena-files/directory.json"+base.SignatureSuffix]
+		assert.NoError(t, base.VerifyDirectory(bucket.content, signature, verifyKey))
+	})
+	t.Run("signing concurrent update", func(t *testing.T) {
+		privateKey, publicKey, err := base.GenerateSigningKey()
+		assert.NoError(t, err)
+		keyFile := filepath.Join(uploader.tempDir, "signing.key")
+		assert.NoError(t, ioutil.WriteFile(keyFile, []byte(privateKey), 0600))
+		signingKey, err := base.LoadSigningKey(keyFile)
+		assert.NoError(t, err)
+		uploader.SetSigningKey(signingKey)
+		defer uploader.SetSigningKey(nil)
+		// another uploader writes its directory and signature between our
+		// directory and our signature.
+		bucket.beforeObjectPut = func() {
+			directory := bucket.directory(t)
+			directory.Books = append(directory.Books, base.Audiobook{ID: "555", Artist: "ae", Title: "tf"})
+			directoryBytes, _ := json.Marshal(directory)
+			bucket.put(directoryBytes)
+			bucket.objects["/tiena-files/directory.json"+base.SignatureSuffix] = base.SignDirectory(directoryBytes, signingKey)
+		}
+		err = uploader.updateDirectory("tiena-files", func(directory *base.AudiobookDirectory) {
+			addOrReplaceAudiobook(directory, base.Audiobook{ID: "666", Artist: "af", Title: "tg"})
+		})
+		assert.NoError(t, err)
+		verifyKey, err := base.ParsePublicKey(publicKey)
+		assert.NoError(t, err)
+		assert.Len(t, bucket.directory(t).Books, 5)
+		signature := bucket.objects["/tiena-files/directory.json"+base.SignatureSuffix]
+		assert.NoError(t, base.VerifyDirectory(bucket.content, signature, verifyKey))
+	})
+	t.Run("refusing newer directory", func(t *testing.T) {
+		bucket.put([]byte(`{"schemaVersion":99,"id":"dir","books":[]}`))
+		err := uploader.updateDirectory("tiena-files", func(directory *base.AudiobookDirectory) {
+			addOrReplaceAudiobook(directory, base.Audiobook{ID: "333", Artist: "ac", Title: "tc"})
+		})
+		assert.Error(t, err)
+	})
+	t.Run("refusing invalid directory", func(t *testing.T) {
+		bucket.put([]byte(`{"id":"dir","books":[`))
+		err := uploader.updateDirectory("tiena-files", func(directory *base.AudiobookDirectory) {
+			addOrReplaceAudiobook(directory, base.Audiobook{ID: "333", Artist: "ac", Title: "tc"})
+		})
+		assert.Error(t, err)
+	})
+}
+
+// fakeBucket is a minimal S3 endpoint serving directory.json with ETags
+// and conditional puts.
+type fakeBucket struct {
+	mutex     sync.Mutex
+	content   []byte
+	version   int
+	beforePut func()
+	// beforeObjectPut is called once before storing another object.
+	beforeObjectPut func()
+	objects         map[string][]byte
+}
+
+func newFakeBucket() *fakeBucket {
+	return &fakeBucket{objects: map[string][]byte{}}
+}
+
+func (b *fakeBucket) etag() string {
+	return fmt.Sprintf("\"%d\"", b.version)
+}
+
+func (b *fakeBucket) put(content []byte) {
+	b.content = content
+	b.version++
+}
+
+func (b *fakeBucket) directory(t *testing.T) *base.AudiobookDirectory {
+	directory := new(base.AudiobookDirectory)
+	assert.NoError(t, json.Unmarshal(b.content, directory))
+	return directory
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if r.URL.Path != "/tiena-files/directory.json" {
+		// other objects are stored unconditionally.
+		if r.Method == http.MethodPut {
+			if b.beforeObjectPut != nil {
+				b.beforeObjectPut()
+				b.beforeObjectPut = nil
+			}
+			b.objects[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if b.content == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>"))
+			return
+		}
+		w.Header().Set("ETag", b.etag())
+		w.Write(b.content)
+	case http.MethodPut:
+		if b.beforePut != nil {
+			b.beforePut()
+			b.beforePut = nil
+		}
+		ifMatch := r.Header.Get("If-Match")
+		ifNoneMatch := r.Header.Get("If-None-Match")
+		if (ifMatch != "" && ifMatch != b.etag()) || (ifNoneMatch == "*" && b.content != nil) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			w.Write([]byte("<Error><Code>PreconditionFailed</Code><Message>precondition failed</Message></Error>"))
+			return
+		}
+		content, _ := ioutil.ReadAll(r.Body)
+		b.put(content)
+		w.Header().Set("ETag", b.etag())
+	}
+}
+
+func newFakeSession(t *testing.T, endpoint string) *session.Session {
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(endpoint),
+		Region:           aws.String("eu-central-1"),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	assert.NoError(t, err)
+	return sess
+}
+
+func TestReadMP3Duration(t *testing.T) {
+	// a single MPEG 1 layer III frame at 128 kbps and 44.1 kHz.
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0x00})
+	stream := []byte{}
+	for i := 0; i < 100; i++ {
+		stream = append(stream, frame...)
+	}
+	duration, err := readMP3Duration(bytes.NewReader(stream))
+	assert.NoError(t, err)
+	// 100 frames of 1152 samples
+	assert.Equal(t, 100*1152*time.Second/44100, duration)
+}
+
+// createFakeEncoder creates an encoder script that logs its arguments and
+// copies the input file to the output file.
+func createFakeEncoder(basepath string) (string, string, error) {
+	encoder := basepath + "/encoder.sh"
+	encoderLog := basepath + "/encoder.log"
+	script := "#!/bin/sh\n" +
+		"echo \"$*\" >> " + encoderLog + "\n" +
+		"while [ \"$1\" != \"-i\" ]; do shift; done\n" +
+		"src=\"$2\"\n" +
+		"for arg in \"$@\"; do dest=\"$arg\"; done\n" +
+		"cp \"$src\" \"$dest\"\n"
+	err := ioutil.WriteFile(encoder, []byte(script), 0755)
+	return encoder, encoderLog, err
+}
+
+func tagSourceFile(path string, title string, track int) error {
+	mp3File, err := id3.Open(path)
+	if err != nil {
+		return err
+	}
+	mp3File.SetTitle(title)
+	mp3File.AddFrames(v2.NewTextFrame(v2.V23FrameTypeMap["TRCK"], strconv.Itoa(track)))
+	return mp3File.Close()
+}
+
 func createSourceMP3Dir(basepath string) (string, error) {
 	fileList := ""
 	for i := 1; i <= numTracks; i++ {
@@ -118,3 +472,20 @@ func contains(s []string, e string) bool {
 	}
 	return false
 }
+
+func TestSortTracks(t *testing.T) {
+	tracks := []*trackMetadata{
+		{Filename: "b.mp3"},
+		{Filename: "x.mp3", Disc: 2, Track: 1},
+		{Filename: "a.mp3"},
+		{Filename: "y.mp3", Disc: 1, Track: 2},
+		{Filename: "z.mp3", Disc: 1, Track: 1},
+	}
+	sortTracks(tracks)
+	filenames := []string{}
+	for _, track := range tracks {
+		filenames = append(filenames, track.Filename)
+	}
+	// untagged files follow the tagged ones.
+	assert.Equal(t, []string{"z.mp3", "y.mp3", "x.mp3", "a.mp3", "b.mp3"}, filenames)
+}